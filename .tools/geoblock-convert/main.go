@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mdouchement/geoblock/lookup"
+)
+
+func main() {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		stop("usage: geoblock-convert DATABASE [OUTPUT]")
+	}
+
+	database := os.Args[1]
+
+	output := strings.TrimSuffix(filepath.Base(database), filepath.Ext(database)) + lookup.CompactExt
+	if len(os.Args) == 3 {
+		output = os.Args[2]
+	}
+
+	err := convert(database, output)
+	if err != nil {
+		stop(err)
+	}
+
+	l, err := lookup.Open(output)
+	if err != nil {
+		stop(output, err)
+	}
+	defer l.Close()
+
+	fmt.Println(lookup.Describe(l))
+}
+
+func convert(database, output string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = lookup.Convert(f, database); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func stop(args ...interface{}) {
+	fmt.Println(args...)
+	os.Exit(1)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mdouchement/geoblock"
+)
+
+func main() {
+	kid := flag.String("key", "", "key ID, as configured in tokens.keys")
+	ttl := flag.Duration("ttl", 72*time.Hour, "token lifetime")
+	flag.Usage = func() {
+		fmt.Println("usage: GEOBLOCK_TOKEN_SECRET=... geoblock-token -key ID [-ttl 72h] SUBJECT")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// The secret is read from the environment to keep it out of the shell history.
+	key := geoblock.TokenKey{
+		ID:     *kid,
+		Secret: os.Getenv("GEOBLOCK_TOKEN_SECRET"),
+	}
+
+	expires := time.Now().Add(*ttl)
+	token, err := geoblock.IssueToken(key, flag.Arg(0), expires)
+	if err != nil {
+		stop(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "expires %s\n", expires.UTC().Format(time.RFC3339))
+	fmt.Println(token)
+}
+
+func stop(args ...interface{}) {
+	fmt.Println(args...)
+	os.Exit(1)
+}
@@ -259,6 +259,9 @@ func astfile(constants []ast.Decl, clauses []ast.Stmt) *ast.File {
 		},
 	}
 
+	// Register the assets to the lookup package
+	f.Decls = append(f.Decls, registerAST())
+
 	// Add tooling
 	f.Decls = append(f.Decls, decompressAST())
 	f.Decls = append(f.Decls, rcatAST()...)
@@ -344,6 +347,34 @@ func craft(filename string) (*ast.GenDecl, *ast.CaseClause, error) {
 	return constant, clause, nil
 }
 
+func registerAST() ast.Decl {
+	return &ast.FuncDecl{
+		Name: &ast.Ident{
+			Name: "init",
+		},
+		Type: &ast.FuncType{
+			Params: &ast.FieldList{},
+		},
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs: []ast.Expr{
+						&ast.Ident{
+							Name: "assets",
+						},
+					},
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{
+						&ast.Ident{
+							Name: "database",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 func decompressAST() ast.Decl {
 	return &ast.FuncDecl{
 		Name: &ast.Ident{
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/mdouchement/geoblock/lookup/ip2locationbin"
+)
+
+func main() {
+	dbtype := flag.String("type", "DB1", "database type (DB1, DB2, DB3 or DB4)")
+	date := flag.String("date", time.Now().UTC().Format("2006-01-02"), "database date")
+	flag.Usage = func() {
+		fmt.Println("usage: ip2location-build [-type DB1] [-date 2006-01-02] INPUT.CSV... OUTPUT.BIN")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(*dbtype), "DB"))
+	if err != nil {
+		stop("invalid type:", *dbtype)
+	}
+
+	d, err := time.Parse("2006-01-02", *date)
+	if err != nil {
+		stop("invalid date:", err)
+	}
+
+	w, err := ip2locationbin.NewWriter(n, d)
+	if err != nil {
+		stop(err)
+	}
+
+	inputs, output := flag.Args()[:flag.NArg()-1], flag.Arg(flag.NArg()-1)
+	for _, input := range inputs {
+		if err = add(w, input); err != nil {
+			stop(input, err)
+		}
+	}
+
+	if err = write(w, output); err != nil {
+		stop(output, err)
+	}
+
+	l, err := lookup.OpenIP2location(output)
+	if err != nil {
+		stop(output, err)
+	}
+	defer l.Close()
+
+	fmt.Println(lookup.Describe(l))
+}
+
+func add(w *ip2locationbin.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return w.AddCSV(f)
+}
+
+func write(w *ip2locationbin.Writer, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = w.WriteTo(f); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func stop(args ...interface{}) {
+	fmt.Println(args...)
+	os.Exit(1)
+}
@@ -0,0 +1,188 @@
+package geoblock
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// Redirect statuses of redirect actions.
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// An action is a validated Action.
+type action struct {
+	Action
+	delay time.Duration
+	url   *template.Template
+}
+
+// newAction validates the given action, fallback is the type of the action when not set and
+// allowed lists the action types available for the rule.
+func newAction(a Action, fallback ActionType, status int, allowed ...ActionType) (*action, error) {
+	if a.Type == "" {
+		a.Type = fallback
+	}
+
+	ok := false
+	for _, t := range allowed {
+		ok = ok || a.Type == t
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported action: %s", a.Type)
+	}
+
+	c := &action{
+		Action: a,
+	}
+
+	var err error
+	if c.delay, err = parseDuration(a.Delay); err != nil || c.delay < 0 {
+		return nil, fmt.Errorf("%s action: invalid delay: %s", a.Type, a.Delay)
+	}
+
+	switch a.Type {
+	case ActionBlock:
+		if c.Status == 0 {
+			c.Status = status
+		}
+		if http.StatusText(c.Status) == "" {
+			return nil, fmt.Errorf("%s action: invalid status: %d", a.Type, c.Status)
+		}
+	case ActionRedirect:
+		if c.Status == 0 {
+			c.Status = http.StatusFound
+		}
+		if !redirectStatuses[c.Status] {
+			return nil, fmt.Errorf("%s action: invalid status: %d", a.Type, c.Status)
+		}
+
+		if a.URL == "" {
+			return nil, fmt.Errorf("%s action: missing url", a.Type)
+		}
+		if c.url, err = template.New("url").Funcs(templateFuncs).Parse(a.URL); err != nil {
+			return nil, fmt.Errorf("%s action: %w", a.Type, err)
+		}
+	case ActionChallenge:
+		if c.Status == 0 {
+			c.Status = status
+		}
+		if http.StatusText(c.Status) == "" {
+			return nil, fmt.Errorf("%s action: invalid status: %d", a.Type, c.Status)
+		}
+
+		if c.Difficulty == 0 {
+			c.Difficulty = DefaultChallengeDifficulty
+		}
+		if c.Difficulty < 0 || c.Difficulty > maxChallengeDifficulty {
+			return nil, fmt.Errorf("%s action: invalid difficulty: %d", a.Type, c.Difficulty)
+		}
+	}
+
+	return c, nil
+}
+
+// String describes the action for the logs.
+func (a *action) String() string {
+	s := string(a.Type)
+	if a.Status != 0 {
+		s += fmt.Sprintf(" %d", a.Status)
+	}
+	if a.delay > 0 {
+		s += " after " + a.delay.String()
+	}
+
+	return s
+}
+
+// wait waits for the delay of the action, it returns false when the request is canceled meanwhile.
+func (a *action) wait(r *http.Request) bool {
+	if a.delay <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(a.delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// setHeaders sets the extra headers of the action on the response.
+func (a *action) setHeaders(w http.ResponseWriter) {
+	for k, v := range a.Headers {
+		w.Header().Set(k, v)
+	}
+
+	if a.BlockedBy != "" {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"blocked-by\"", a.BlockedBy))
+	}
+}
+
+// checkLocation returns an error if the given redirection can leave the sites of the URL template:
+// browsers drop control characters and read backslashes as slashes, so that the request path
+// (e.g. //evil.example or /\t/evil.example) would be read as a host.
+func checkLocation(location string) error {
+	if hasControl(location) {
+		return fmt.Errorf("invalid location %q: control character", location)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid location %q", location)
+	}
+
+	switch {
+	case u.Scheme == "" && (u.Host != "" || strings.HasPrefix(location, "/\\") || strings.HasPrefix(location, "\\")):
+		return fmt.Errorf("invalid location %q: scheme-relative", location)
+	case u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("invalid location %q: unsupported scheme", location)
+	case u.Scheme != "" && u.Host == "":
+		return fmt.Errorf("invalid location %q: missing host", location)
+	}
+
+	return nil
+}
+
+// hasControl returns true if the given string has a control character.
+func hasControl(s string) bool {
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redirect responds with a redirection to the rendered URL of the action.
+func (a *action) redirect(w http.ResponseWriter, data BlockPageData) error {
+	var location bytes.Buffer
+	if err := a.url.Execute(&location, data); err != nil {
+		return err
+	}
+
+	v := strings.TrimSpace(location.String())
+	if err := checkLocation(v); err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", v)
+	w.Header().Set("Cache-Control", "no-store, private")
+	w.WriteHeader(a.Status)
+	return nil
+}
@@ -0,0 +1,226 @@
+package geoblock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Block page media types, in preference order when the client accepts several of them.
+const (
+	MediaTypeHTML  = "text/html"
+	MediaTypeJSON  = "application/json"
+	MediaTypePlain = "text/plain"
+)
+
+// Default block page templates.
+const (
+	DefaultBlockPageHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>Access from your location{{if .Country}} ({{.Country}}){{end}} is not allowed.</p>
+<p><small>IP: {{.IP}} - Request ID: {{.RequestID}} - {{.Timestamp.Format "2006-01-02T15:04:05Z07:00"}}</small></p>
+</body>
+</html>
+`
+	DefaultBlockPageJSON = `{"status":{{.Status}},"error":{{json .StatusText}},"country":{{json .Country}},"ip":{{json .IP}},"request_id":{{json .RequestID}},"timestamp":{{json .Timestamp}}}
+`
+	DefaultBlockPagePlain = `{{.Status}} {{.StatusText}}: access from your location{{if .Country}} ({{.Country}}){{end}} is not allowed.
+IP: {{.IP}}
+Request ID: {{.RequestID}}
+`
+)
+
+// A BlockPageData is the data available in block page and redirect URL templates.
+type BlockPageData struct {
+	Status     int
+	StatusText string
+	Country    string // Uppercased ISO 3166 country code, empty when unknown.
+	IP         string
+	RequestID  string // From the X-Request-Id header, generated otherwise.
+	Host       string
+	Path       string // Escaped request path.
+	Timestamp  time.Time
+}
+
+// Functions available in text templates.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// A blockPage renders the body of blocked responses.
+type blockPage struct {
+	templates map[string]executor // Per media type.
+}
+
+// newBlockPage parses the block page templates of the given config.
+func newBlockPage(c BlockPage) (*blockPage, error) {
+	p := &blockPage{
+		templates: make(map[string]executor),
+	}
+
+	for _, variant := range []struct {
+		mediaType string
+		inline    string
+		filename  string
+		fallback  string
+	}{
+		{mediaType: MediaTypeHTML, inline: c.HTML, filename: c.HTMLFile, fallback: DefaultBlockPageHTML},
+		{mediaType: MediaTypeJSON, inline: c.JSON, filename: c.JSONFile, fallback: DefaultBlockPageJSON},
+		{mediaType: MediaTypePlain, inline: c.Plain, filename: c.PlainFile, fallback: DefaultBlockPagePlain},
+	} {
+		text := variant.inline
+		if variant.filename != "" {
+			b, err := os.ReadFile(variant.filename)
+			if err != nil {
+				return nil, err
+			}
+
+			text = string(b)
+		}
+		if text == "" {
+			text = variant.fallback
+		}
+
+		var err error
+		if variant.mediaType == MediaTypeHTML {
+			p.templates[variant.mediaType], err = htmltemplate.New(variant.mediaType).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(text)
+		} else {
+			p.templates[variant.mediaType], err = template.New(variant.mediaType).Funcs(templateFuncs).Parse(text)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// newBlockPageData returns the template data of the given request.
+func newBlockPageData(r *http.Request, status int, country, ip string) BlockPageData {
+	data := BlockPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Country:    strings.ToUpper(country),
+		IP:         ip,
+		RequestID:  r.Header.Get("X-Request-Id"),
+		Host:       r.Host,
+		Path:       r.URL.EscapedPath(),
+		Timestamp:  time.Now().UTC(),
+	}
+	if data.RequestID == "" {
+		data.RequestID = requestID()
+	}
+
+	return data
+}
+
+// Write writes the block page negotiated from the Accept header of the request.
+// Block pages depend on the client and must never be cached by shared caches.
+func (p *blockPage) Write(w http.ResponseWriter, r *http.Request, data BlockPageData) {
+	w.Header().Set("Cache-Control", "no-store, private")
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("X-Request-Id", data.RequestID)
+
+	mediaType := negotiate(r.Header.Get("Accept"))
+	if mediaType == "" {
+		w.WriteHeader(data.Status)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := p.templates[mediaType].Execute(&body, data); err != nil {
+		log.Printf("block page: %s: %v", mediaType, err)
+		w.WriteHeader(data.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.Status)
+	_, _ = body.WriteTo(w)
+}
+
+// negotiate returns the block page media type preferred by the given Accept header.
+// It returns an empty string when none of them is acceptable.
+func negotiate(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return MediaTypeHTML
+	}
+
+	best, quality := "", 0.0
+	for _, mediaType := range []string{MediaTypeHTML, MediaTypeJSON, MediaTypePlain} {
+		if q := acceptable(accept, mediaType); q > quality {
+			best, quality = mediaType, q
+		}
+	}
+
+	return best
+}
+
+// acceptable returns the quality of the given media type in the Accept header, the most specific range wins.
+func acceptable(accept, mediaType string) float64 {
+	kind, _, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, v := range strings.Split(accept, ",") {
+		r, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch r {
+		case mediaType:
+			s = 2
+		case kind + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		quality, specificity = q, s
+	}
+
+	return quality
+}
+
+// requestID returns a random request ID.
+func requestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+package geoblock
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// acmeChallengePath is the path prefix of the ACME HTTP-01 challenges (RFC 8555 section 8.3).
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// A bypass is a validated Bypass.
+type bypass struct {
+	match *matcher
+}
+
+// newBypasses validates the bypass list of the given config, the ACME challenge bypass comes first when enabled.
+func newBypasses(c Config) ([]bypass, error) {
+	var bypasses []bypass
+
+	if c.AllowLetsEncrypt {
+		bypasses = append(bypasses, bypass{
+			match: &matcher{
+				paths:   []func(string) bool{acmeChallenge},
+				methods: map[string]bool{http.MethodGet: true, http.MethodHead: true},
+			},
+		})
+	}
+
+	for i, b := range c.Bypass {
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		m, err := newMatcher(b.Match, true)
+		if err != nil {
+			return nil, fmt.Errorf("bypass %q: %w", b.Name, err)
+		}
+		if m == nil {
+			// An empty match would bypass all the requests.
+			return nil, fmt.Errorf("bypass %q: empty match", b.Name)
+		}
+		if len(b.Match.Headers) > 0 && len(b.Match.Paths) == 0 && len(b.Match.Hosts) == 0 {
+			// Any client can send the headers (and choose the method).
+			return nil, fmt.Errorf("bypass %q: headers must be restricted to paths or hosts", b.Name)
+		}
+
+		bypasses = append(bypasses, bypass{match: m})
+	}
+
+	return bypasses, nil
+}
+
+// acmeChallenge returns true if the given path is an ACME challenge path with a well-formed token,
+// so that the exemption can't be used to reach other paths.
+func acmeChallenge(path string) bool {
+	if !strings.HasPrefix(path, acmeChallengePath) {
+		return false
+	}
+
+	// Tokens are base64url-encoded without padding and contain at least 128 bits of entropy.
+	token := path[len(acmeChallengePath):]
+	if len(token) < 22 || len(token) > 256 {
+		return false
+	}
+
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bypassed returns true if one of the bypasses matches the given request.
+func bypassed(bypasses []bypass, r *http.Request) bool {
+	for _, b := range bypasses {
+		if b.match.match(r) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,221 @@
+package geoblock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// DefaultClientCertHeader is the default forwarded client certificate header, as set by the Traefik passTLSClientCert middleware.
+const DefaultClientCertHeader = "X-Forwarded-Tls-Client-Cert"
+
+// Client certificate attributes matched by cert rules.
+const (
+	certCN     = "cn"     // Subject common name.
+	certOU     = "ou"     // Subject organizational unit.
+	certSAN    = "san"    // DNS name, email address, URI or IP subject alternative name.
+	certIssuer = "issuer" // Issuer common name or distinguished name.
+	certSPKI   = "spki"   // Hex or base64 SHA-256 fingerprint of the subject public key info.
+)
+
+type certRule struct {
+	match func(cert *x509.Certificate) bool
+	rule  *rule
+}
+
+// certMatcher returns the certificate matcher of the given cert rule value (e.g. cn:partner.example.com).
+func certMatcher(v string) (func(cert *x509.Certificate) bool, error) {
+	attribute, value, ok := strings.Cut(v, ":")
+	value = strings.TrimSpace(value)
+	if !ok || value == "" {
+		return nil, errors.New("expected ATTRIBUTE:VALUE")
+	}
+
+	switch strings.ToLower(attribute) {
+	case certCN:
+		return func(cert *x509.Certificate) bool {
+			return strings.EqualFold(cert.Subject.CommonName, value)
+		}, nil
+	case certOU:
+		return func(cert *x509.Certificate) bool {
+			return contains(cert.Subject.OrganizationalUnit, value)
+		}, nil
+	case certSAN:
+		return func(cert *x509.Certificate) bool {
+			if contains(cert.DNSNames, value) || contains(cert.EmailAddresses, value) {
+				return true
+			}
+			for _, u := range cert.URIs {
+				if u.String() == value {
+					return true
+				}
+			}
+			for _, ip := range cert.IPAddresses {
+				if ip.String() == value {
+					return true
+				}
+			}
+
+			return false
+		}, nil
+	case certIssuer:
+		return func(cert *x509.Certificate) bool {
+			return strings.EqualFold(cert.Issuer.CommonName, value) || strings.EqualFold(cert.Issuer.String(), value)
+		}, nil
+	case certSPKI:
+		fingerprint, err := parseFingerprint(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(cert *x509.Certificate) bool {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			return bytes.Equal(sum[:], fingerprint)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown attribute: %s", attribute)
+	}
+}
+
+// parseFingerprint parses a SHA-256 fingerprint in hex (with optional colons) or base64 (e.g. an HPKP pin).
+func parseFingerprint(v string) ([]byte, error) {
+	if b, err := hex.DecodeString(strings.ReplaceAll(v, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+
+	if b, err := base64.StdEncoding.DecodeString(v); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("invalid sha256 fingerprint: %s", v)
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certificate returns the client certificate of the given request: the TLS peer certificate verified by Traefik,
+// or the forwarded certificate header when the peer is a trusted proxy.
+// Forwarded certificates can't be verified here, the proxy must only forward the certificates it verified.
+func (e *Evaluator) certificate(r *http.Request) (*x509.Certificate, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		// Certificates requested but not verified (clientAuthType: RequestClientCert) are ignored.
+		if len(r.TLS.VerifiedChains) == 0 {
+			return nil, nil
+		}
+
+		return r.TLS.VerifiedChains[0][0], nil
+	}
+
+	v := r.Header.Get(e.certHeader)
+	if v == "" || !e.trusted(r.RemoteAddr) {
+		return nil, nil
+	}
+
+	cert, err := parseForwardedCert(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.certHeader, err)
+	}
+
+	return cert, nil
+}
+
+// trusted returns true if the given remote address is a trusted proxy.
+func (e *Evaluator) trusted(remote string) bool {
+	addr, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return false
+	}
+
+	return e.trustedIP(addr.Addr())
+}
+
+// trustedIP returns true if the given IP is a trusted proxy.
+func (e *Evaluator) trustedIP(ip netip.Addr) bool {
+	ip = ip.WithZone("").Unmap()
+	for _, proxy := range e.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseForwardedCert parses the first certificate of a forwarded certificate header:
+// URL-escaped base64 DER certificates separated by commas, with or without PEM delimiters.
+func parseForwardedCert(v string) (*x509.Certificate, error) {
+	v, err := url.PathUnescape(v) // Keeps the + of unescaped values.
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, _ = strings.Cut(v, ",")
+
+	// PEM delimiters are dropped whatever their escaping (e.g. -----BEGIN+CERTIFICATE-----).
+	for {
+		start := strings.Index(v, "-----")
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(v[start+5:], "-----")
+		if end < 0 {
+			break
+		}
+
+		v = v[:start] + v[start+5+end+5:]
+	}
+	v = strings.Join(strings.Fields(v), "")
+
+	der, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// parseProxies parses the given trusted proxies, IPs or CIDRs.
+func parseProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, v := range proxies {
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", v)
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", v)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
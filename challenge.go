@@ -0,0 +1,329 @@
+package geoblock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengePath is the path where the challenge page submits the solutions.
+const ChallengePath = "/.well-known/geoblock/challenge"
+
+// Challenge defaults.
+const (
+	DefaultChallengeCookie     = "geoblock_challenge"
+	DefaultChallengeTTL        = 24 * time.Hour
+	DefaultChallengeDifficulty = 16 // About 65k hashes, a fraction of a second in a browser.
+	maxChallengeDifficulty     = 32
+	challengeTimeout           = 5 * time.Minute // Time to solve a challenge.
+)
+
+// Challenge verification errors.
+var (
+	errChallengeMalformed = errors.New("malformed challenge")
+	errChallengeSignature = errors.New("invalid challenge signature")
+	errChallengeExpired   = errors.New("expired challenge")
+	errChallengeSolution  = errors.New("invalid solution")
+)
+
+// The challenge page finds a nonce such that SHA-256(challenge + ":" + nonce) starts with
+// difficulty zero bits, with a pure JavaScript SHA-256 as crypto.subtle is only available over HTTPS.
+var challengePage = htmltemplate.Must(htmltemplate.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Checking your browser</title></head>
+<body>
+<h1>Checking your browser</h1>
+<p>This takes a few seconds.</p>
+<noscript><p>JavaScript is required to access this site.</p></noscript>
+<script>
+(function () {
+  var challenge = {{.Challenge}}, difficulty = {{.Difficulty}}, action = {{.Action}}, redirect = {{.Redirect}};
+  var K = [0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2];
+
+  // sha256 returns the hash of an ASCII string as 8 words.
+  function sha256(s) {
+    var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    var m = [], w = [], l = s.length, i, j;
+    for (i = 0; i < l; i++) m[i >> 2] |= s.charCodeAt(i) << (24 - (i % 4) * 8);
+    m[l >> 2] |= 0x80 << (24 - (l % 4) * 8);
+    m[(((l + 8) >> 6) << 4) + 15] = l * 8;
+    for (i = 0; i < m.length; i += 16) {
+      var a = H.slice(0);
+      for (j = 0; j < 64; j++) {
+        if (j < 16) {
+          w[j] = m[i + j] | 0;
+        } else {
+          var x = w[j - 15], y = w[j - 2];
+          w[j] = ((x >>> 7 | x << 25) ^ (x >>> 18 | x << 14) ^ (x >>> 3)) + w[j - 16] +
+            ((y >>> 17 | y << 15) ^ (y >>> 19 | y << 13) ^ (y >>> 10)) + w[j - 7] | 0;
+        }
+        var e = a[4], c = a[0];
+        var t1 = a[7] + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) + ((e & a[5]) ^ (~e & a[6])) + K[j] + w[j] | 0;
+        var t2 = ((c >>> 2 | c << 30) ^ (c >>> 13 | c << 19) ^ (c >>> 22 | c << 10)) + ((c & a[1]) ^ (c & a[2]) ^ (a[1] & a[2])) | 0;
+        a = [t1 + t2 | 0].concat(a);
+        a[4] = a[4] + t1 | 0;
+        a.pop();
+      }
+      for (j = 0; j < 8; j++) H[j] = H[j] + a[j] | 0;
+    }
+    return H;
+  }
+
+  function zeros(h) {
+    for (var i = 0, n = 0; i < h.length; i++) {
+      n += Math.clz32(h[i]);
+      if (h[i] !== 0) break;
+    }
+    return n;
+  }
+
+  var nonce = 0;
+  (function solve() {
+    for (var end = nonce + 5000; nonce < end; nonce++) {
+      if (zeros(sha256(challenge + ":" + nonce)) >= difficulty) {
+        location.replace(action + "?c=" + encodeURIComponent(challenge) + "&n=" + nonce + "&r=" + encodeURIComponent(redirect));
+        return;
+      }
+    }
+    setTimeout(solve, 0);
+  })();
+})();
+</script>
+</body>
+</html>
+`))
+
+// A challenge issues and verifies the proof-of-work challenges and the pass cookies of challenge actions.
+type challenge struct {
+	secret []byte
+	ttl    time.Duration
+	cookie string
+}
+
+// newChallenge validates the given challenge config, it returns nil when no secret is configured.
+func newChallenge(c Challenge) (*challenge, error) {
+	if c.Secret == "" {
+		return nil, nil
+	}
+
+	if len(c.Secret) < minTokenSecret {
+		return nil, fmt.Errorf("secret shorter than %d bytes", minTokenSecret)
+	}
+
+	ttl, err := parseDuration(c.TTL)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid ttl: %s", c.TTL)
+	}
+	if ttl == 0 {
+		ttl = DefaultChallengeTTL
+	}
+
+	ch := &challenge{
+		secret: []byte(c.Secret),
+		ttl:    ttl,
+		cookie: c.Cookie,
+	}
+	if ch.cookie == "" {
+		ch.cookie = DefaultChallengeCookie
+	}
+
+	return ch, nil
+}
+
+// usesChallenge returns true if one of the rules of the given config has a challenge action.
+func usesChallenge(c Config) bool {
+	lists := [][]Rule{c.Allowlist, c.Blocklist}
+	for _, p := range c.Policies {
+		lists = append(lists, p.Allowlist, p.Blocklist)
+	}
+
+	for _, list := range lists {
+		for _, r := range list {
+			if r.Action.Type == ActionChallenge {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *challenge) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issue returns a challenge bound to the given IP: <expiry>.<difficulty>.<random>.<signature>.
+func (c *challenge) issue(ip string, difficulty int, now time.Time) string {
+	payload := strconv.FormatInt(now.Add(challengeTimeout).Unix(), 10) + "." + strconv.Itoa(difficulty) + "." + requestID()
+	return payload + "." + c.sign("challenge", ip, payload)
+}
+
+// verify returns the difficulty of the given challenge when it was issued for the IP and is solved by the nonce.
+func (c *challenge) verify(token, nonce, ip string, now time.Time) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return 0, errChallengeMalformed
+	}
+
+	if !hmac.Equal([]byte(parts[3]), []byte(c.sign("challenge", ip, strings.Join(parts[:3], ".")))) {
+		return 0, errChallengeSignature
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, errChallengeMalformed
+	}
+	if now.Unix() >= expires {
+		return 0, errChallengeExpired
+	}
+
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, errChallengeMalformed
+	}
+
+	if _, err = strconv.ParseUint(nonce, 10, 64); err != nil || !solved(token, nonce, difficulty) {
+		return 0, errChallengeSolution
+	}
+
+	return difficulty, nil
+}
+
+// solved returns true if SHA-256(token:nonce) starts with difficulty zero bits.
+func solved(token, nonce string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(token + ":" + nonce))
+
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return n >= difficulty
+}
+
+// pass returns the pass cookie value of the given IP: <expiry>.<difficulty>.<signature>.
+func (c *challenge) pass(ip string, difficulty int, now time.Time) string {
+	payload := strconv.FormatInt(now.Add(c.ttl).Unix(), 10) + "." + strconv.Itoa(difficulty)
+	return payload + "." + c.sign("pass", ip, payload)
+}
+
+// passed returns true if the request has a valid pass cookie of the IP for at least the given difficulty.
+func (c *challenge) passed(r *http.Request, ip string, difficulty int, now time.Time) bool {
+	cookie, err := r.Cookie(c.cookie)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(c.sign("pass", ip, parts[0]+"."+parts[1]))) {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+
+	d, err := strconv.Atoi(parts[1])
+	return err == nil && d >= difficulty
+}
+
+// write responds with a challenge page bound to the given IP.
+func (c *challenge) write(w http.ResponseWriter, status int, ip string, difficulty int, redirect string) {
+	var body bytes.Buffer
+	err := challengePage.Execute(&body, struct {
+		Challenge  string
+		Difficulty int
+		Action     string
+		Redirect   string
+	}{
+		Challenge:  c.issue(ip, difficulty, time.Now()),
+		Difficulty: difficulty,
+		Action:     ChallengePath,
+		Redirect:   redirect,
+	})
+	if err != nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store, private")
+	w.Header().Set("Content-Type", MediaTypeHTML+"; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = body.WriteTo(w)
+}
+
+// localRedirect returns the given redirection when it is a path of the same site, / otherwise.
+// Browsers drop the tabs and newlines of the locations and read backslashes as slashes, so /\t/evil.example
+// or /\evil.example would leave the site.
+func localRedirect(v string) string {
+	if !strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//") || strings.HasPrefix(v, "/\\") {
+		return "/"
+	}
+
+	if hasControl(v) {
+		return "/"
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+
+	return v
+}
+
+// solve verifies the solution submitted by a challenge page for one of the given IPs.
+// A pass cookie is set on success, the client is redirected to the challenged page in all cases.
+func (c *challenge) solve(w http.ResponseWriter, r *http.Request, ips []string) (string, int, error) {
+	q := r.URL.Query()
+
+	w.Header().Set("Cache-Control", "no-store, private")
+	w.Header().Set("Location", localRedirect(q.Get("r")))
+	defer w.WriteHeader(http.StatusSeeOther)
+
+	now := time.Now()
+	err := errChallengeMalformed
+	for _, ip := range ips {
+		var difficulty int
+		if difficulty, err = c.verify(q.Get("c"), q.Get("n"), ip, now); err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     c.cookie,
+				Value:    c.pass(ip, difficulty, now),
+				Path:     "/",
+				MaxAge:   int(c.ttl.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			return ip, difficulty, nil
+		}
+	}
+
+	return "", 0, err
+}
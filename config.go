@@ -10,6 +10,24 @@ import (
 const (
 	RuleTypeCountry RuleType = "country"
 	RuleTypeCIDR    RuleType = "cidr"
+	RuleTypeRegion  RuleType = "region"  // Region name (e.g. California), requires a database with regions.
+	RuleTypeASN     RuleType = "asn"     // Autonomous system number (e.g. AS13335), requires a database with ASNs.
+	RuleTypeCert    RuleType = "cert"    // Client certificate attribute: cn:, ou:, san:, issuer: or spki: (SHA-256) prefixed value.
+	RuleTypeCrawler RuleType = "crawler" // Verified search engine crawler (e.g. googlebot), see Crawler.
+)
+
+// Rule actions.
+const (
+	ActionAllow     ActionType = "allow"     // Forward the request, default of allowlist rules.
+	ActionBlock     ActionType = "block"     // Respond with the block page, default of blocklist rules.
+	ActionRedirect  ActionType = "redirect"  // Redirect the request, only for blocklist rules.
+	ActionChallenge ActionType = "challenge" // Serve a proof-of-work challenge page, only for blocklist rules.
+)
+
+// Supported modes.
+const (
+	ModeEnforce = "enforce" // Apply the decisions.
+	ModeMonitor = "monitor" // Log and count the decisions but forward all the requests.
 )
 
 // Supported default actions.
@@ -21,23 +39,149 @@ const (
 type (
 	// A Config defines the plugin configuration.
 	Config struct {
-		Enabled              bool            // Enable this plugin?
-		AllowLetsEncrypt     bool            // Allow Let's Encrypt challenge path.
-		Databases            []string        // Path to ip2location database files.
+		Enabled              bool            // Enable blocking?
+		AllowLetsEncrypt     bool            // Bypass the ACME HTTP-01 challenge requests (GET or HEAD with a valid token).
+		Overrides            []string        // Path to override files (YAML or CSV) mapping CIDRs to countries, they take precedence over Databases.
+		Databases            []string        // Database specs: paths or scheme-prefixed names (e.g. mmdb:/path/GeoLite2-Country.mmdb), see lookup.Spec.
 		DatabaseReaders      []lookup.Reader // Overrides Databases paths mostly for test purposes.
 		DisallowedStatusCode int             // HTTP status code to return for disallowed requests.
 		DefaultAction        string          // Default action to perform when there is no specified rule.
+		Mode                 string          // enforce (default) or monitor to only log and count the blocked requests.
+		MaxDatabaseAge       string          // Maximum age of the databases (e.g. 45d or 1080h), no limit when empty. Checked at startup, and on each update check of the updated databases.
+		RefuseStaleDatabases bool            // Refuse to start instead of warning when a database is older than MaxDatabaseAge, updated databases are only warned about afterwards.
+		InMemory             bool            // Compile ip2location databases in memory for faster lookups (countries only).
+		DatabaseUpdates      []DatabaseUpdate
+		BlockPage            BlockPage
+		Enrichment           Enrichment
+		Bypass               []Bypass  // Requests forwarded without evaluation (e.g. health checks).
+		Tokens               Tokens    // Signed tokens forwarding the requests of their bearers without evaluation.
+		Challenge            Challenge // Required by challenge actions.
+		TrustedProxies       []string  // Proxies (IPs or CIDRs) whose ClientCertHeader is trusted by cert rules as verified by them, skipped in X-Forwarded-For by Enrichment.
+		ClientCertHeader     string    // Forwarded client certificate header, defaults to X-Forwarded-Tls-Client-Cert.
+		Crawlers             []Crawler // Crawlers of crawler rules, added to or overriding the built-in googlebot and bingbot.
+		Resolver             Resolver  // Overrides the DNS resolver of the crawler verifications mostly for test purposes.
+		Policies             []Policy  // Policies for some requests, the first matching policy replaces the lists below.
 		Allowlist            []Rule
 		Blocklist            []Rule
 	}
 
+	// A Policy applies its own rules to the requests it matches.
+	Policy struct {
+		Name          string // Name used in logs.
+		Match         Match
+		DefaultAction string // Defaults to the DefaultAction of the configuration.
+		Allowlist     []Rule
+		Blocklist     []Rule
+	}
+
+	// A Bypass forwards the requests it matches without evaluating them.
+	// Its plain paths are exact paths, or prefixes when they end with a slash (/static/).
+	// Its headers must be restricted to paths or hosts.
+	Bypass struct {
+		Name  string // Name used in error messages.
+		Match Match  // Must have at least one condition.
+	}
+
+	// Tokens configures the signed bypass tokens (see IssueToken), disabled without keys.
+	// A token is read from the header, the cookie or the query parameter, in this order.
+	Tokens struct {
+		Keys   []TokenKey // Active keys, any of them verifies the tokens it issued.
+		Header string     // Defaults to X-Geoblock-Token.
+		Cookie string     // Defaults to geoblock_token.
+		Query  string     // Defaults to geoblock_token.
+	}
+
+	// A TokenKey signs and verifies bypass tokens, keys are rotated by issuing tokens with a new key
+	// and removing the old one once its tokens have expired.
+	TokenKey struct {
+		ID     string // Key identifier embedded in the tokens, without dots.
+		Secret string // HMAC-SHA256 key, at least 32 bytes.
+	}
+
+	// A Crawler is a search engine crawler of crawler rules: its User-Agent must match and its IP must be in
+	// one of its published ranges or have a reverse DNS name in one of its domains resolving back to it.
+	Crawler struct {
+		Name      string   // Value of the crawler rules.
+		UserAgent string   // Case insensitive User-Agent substring.
+		Domains   []string // Domains of the reverse DNS names (e.g. googlebot.com), no DNS verification when empty.
+		Ranges    []string // IP ranges JSON files published by the vendor (e.g. googlebot.json).
+	}
+
+	// A Match restricts a policy or a rule to some requests, all the set conditions must be met.
+	Match struct {
+		Paths   []string // Path prefixes (/api/), globs with * and ** (/admin/**) or regular expressions prefixed by ~ (~^/v[0-9]+/).
+		Hosts   []string // Hosts, *.example.com matches the subdomains.
+		Methods []string
+		Headers []string // Request headers which must be present, whatever their value: clients can send them too.
+	}
+
+	// A DatabaseUpdate keeps one of the Databases up to date from a remote URL, checked at startup then every Interval.
+	// The database must be an uncompressed file and cannot be pinned with a sha256 option.
+	// Instances updating the same database with the same settings share one updater.
+	DatabaseUpdate struct {
+		Database     string // Database to update, as written in Databases.
+		URL          string // Download URL (can be a zip or gzip archive), {token} is replaced by Token.
+		Token        string // IP2Location download token.
+		Interval     string // Update interval (e.g. 1d or 12h), defaults to 24h.
+		ProbeIP      string // IP queried to verify the downloaded database, defaults to 1.1.1.1.
+		ProbeCountry string // Country expected for ProbeIP, defaults to US.
+	}
+
+	// A BlockPage customizes the body of blocked responses with Go templates (see BlockPageData),
+	// the variant is chosen from the Accept header and defaults are used for the empty ones.
+	BlockPage struct {
+		HTML      string // Inline html/template template.
+		HTMLFile  string // html/template template file, takes precedence over HTML.
+		JSON      string // Inline text/template template, with a json function to quote values.
+		JSONFile  string
+		Plain     string // Inline text/template template.
+		PlainFile string
+	}
+
+	// An Enrichment forwards the client location and the decision to the backend in request headers
+	// (<Prefix>IP, Country, Region, City, ISP, ASN, Decision and Timestamp), also when blocking is disabled.
+	// Client-supplied headers with the prefix are removed.
+	Enrichment struct {
+		Enabled bool
+		Prefix  string // Header prefix, defaults to X-Geo-.
+		Secret  string // HMAC-SHA256 key of the <Prefix>Signature header (see EnrichmentSignature), no signature when empty.
+		// The client is the rightmost X-Forwarded-For entry outside of the TrustedProxies, or the entry before
+		// the given number of trusted hops when set (e.g. 1 behind a CDN appending the client IP).
+		TrustedHops int
+	}
+
 	// A RuleType defines the type of a rule.
 	RuleType string
 
 	// A Rule is used to define if a request can be allowed or blocked.
 	Rule struct {
-		Type  RuleType
-		Value string
+		Type    RuleType
+		Value   string
+		Action  Action
+		Monitor bool  // Log and count the decisions of the rule without enforcing them.
+		Match   Match // Requests the rule applies to, all of them when empty.
+	}
+
+	// An ActionType defines the type of an action.
+	ActionType string
+
+	// An Action is the response to the requests matched by a rule.
+	Action struct {
+		Type       ActionType        // Defaults to allow for allowlist rules and to block for blocklist rules.
+		Status     int               // Block status (e.g. 451, defaults to DisallowedStatusCode) or redirect status (defaults to 302).
+		URL        string            // Redirect URL template with the block page data (e.g. https://{{lower .Country}}.example.com{{.Path}}), .Host must not be its authority.
+		BlockedBy  string            // URL of the entity implementing the block, sent in a Link rel="blocked-by" header (RFC 7725).
+		Delay      string            // Delay before responding or forwarding the request (e.g. 2s), to slow down clients.
+		Headers    map[string]string // Extra response headers.
+		Difficulty int               // Leading zero bits of the challenge proof-of-work (1 to 32), defaults to 16.
+	}
+
+	// A Challenge configures the proof-of-work challenges of challenge actions: the challenge page solves
+	// a SHA-256 proof-of-work in JavaScript and gets a pass cookie bound to the client IP.
+	Challenge struct {
+		Secret string // HMAC-SHA256 key of the challenges and of the pass cookies, at least 32 bytes.
+		TTL    string // Lifetime of the pass cookies (e.g. 12h), defaults to 24h.
+		Cookie string // Pass cookie name, defaults to geoblock_challenge.
 	}
 )
 
@@ -0,0 +1,337 @@
+package geoblock
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Crawler verification settings.
+const (
+	crawlerTimeout    = 2 * time.Second // DNS lookups timeout.
+	crawlerCacheTTL   = time.Hour
+	crawlerCacheSize  = 10000 // The least recently used verifications are evicted when full.
+	crawlerMaxLookups = 2     // DNS verifications per request, the IPs beyond are not verified.
+	crawlerMaxNames   = 4     // Reverse DNS names confirmed per IP.
+)
+
+// A Resolver resolves the names of the crawler verifications, net.DefaultResolver is used by default.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Built-in crawlers of crawler rules, verified with forward-confirmed reverse DNS.
+// googleusercontent.com is left out: Google Cloud VMs get reverse DNS names under it.
+var defaultCrawlers = []Crawler{
+	{
+		Name:      "googlebot",
+		UserAgent: "Googlebot",
+		Domains:   []string{"googlebot.com", "google.com"},
+	},
+	{
+		Name:      "bingbot",
+		UserAgent: "bingbot",
+		Domains:   []string{"search.msn.com"},
+	},
+}
+
+// A crawler is a validated Crawler.
+type crawler struct {
+	Crawler
+	prefixes []netip.Prefix
+}
+
+// A crawlers verifies the crawlers of crawler rules.
+type crawlers struct {
+	resolver Resolver
+	known    map[string]*crawler // Per lowercased name.
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // Per crawler name and IP, of crawlerEntry.
+	lru   *list.List               // Most recently used first.
+	calls map[string]*crawlerCall  // In-flight verifications, shared by the concurrent requests.
+}
+
+type crawlerEntry struct {
+	key      string
+	verified bool
+	expires  time.Time
+}
+
+type crawlerCall struct {
+	done     chan struct{}
+	verified bool
+}
+
+// newCrawlers returns the built-in crawlers overridden by the configured ones.
+// Configured crawlers replace the non-empty fields of the built-in ones with the same name.
+func newCrawlers(configured []Crawler, resolver Resolver) (*crawlers, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	c := &crawlers{
+		resolver: resolver,
+		known:    make(map[string]*crawler),
+		cache:    make(map[string]*list.Element),
+		lru:      list.New(),
+		calls:    make(map[string]*crawlerCall),
+	}
+
+	for _, v := range defaultCrawlers {
+		c.known[v.Name] = &crawler{Crawler: v}
+	}
+
+	for _, v := range configured {
+		name := strings.ToLower(v.Name)
+		if name == "" {
+			return nil, fmt.Errorf("crawler: missing name")
+		}
+
+		k, ok := c.known[name]
+		if !ok {
+			k = &crawler{Crawler: Crawler{Name: name}}
+			c.known[name] = k
+		}
+
+		if v.UserAgent != "" {
+			k.UserAgent = v.UserAgent
+		}
+		if v.Domains != nil {
+			k.Domains = v.Domains
+		}
+
+		for _, filename := range v.Ranges {
+			prefixes, err := loadCrawlerRanges(filename)
+			if err != nil {
+				return nil, fmt.Errorf("crawler %q: %w", name, err)
+			}
+
+			k.prefixes = append(k.prefixes, prefixes...)
+		}
+
+		if k.UserAgent == "" {
+			return nil, fmt.Errorf("crawler %q: missing user agent", name)
+		}
+		if len(k.Domains) == 0 && len(k.prefixes) == 0 {
+			return nil, fmt.Errorf("crawler %q: no domain nor range to verify it", name)
+		}
+	}
+
+	return c, nil
+}
+
+// loadCrawlerRanges loads the IP ranges published by a crawler vendor
+// (e.g. https://developers.google.com/search/apis/ipranges/googlebot.json).
+func loadCrawlerRanges(filename string) ([]netip.Prefix, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err = json.Unmarshal(b, &ranges); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(ranges.Prefixes))
+	for _, v := range ranges.Prefixes {
+		prefix, err := netip.ParsePrefix(v.IPv4Prefix + v.IPv6Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// get returns the crawler of the given crawler rule value.
+func (c *crawlers) get(name string) (*crawler, error) {
+	k, ok := c.known[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return nil, fmt.Errorf("unknown crawler: %s", name)
+	}
+
+	return k, nil
+}
+
+// verify returns true if the given request comes from the given crawler:
+// its User-Agent matches and its IP is in the published ranges or is confirmed by reverse DNS.
+func (c *crawlers) verify(r *http.Request, k *crawler, ip netip.Addr) bool {
+	if r == nil || !strings.Contains(strings.ToLower(r.UserAgent()), strings.ToLower(k.UserAgent)) {
+		return false
+	}
+
+	for _, prefix := range k.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	if len(k.Domains) == 0 {
+		return false
+	}
+
+	key := k.Name + "/" + ip.String()
+
+	c.mu.Lock()
+	if verified, ok := c.cached(key); ok {
+		c.mu.Unlock()
+		return verified
+	}
+
+	call, ok := c.calls[key]
+	if !ok {
+		if !spendCrawlerLookup(r.Context()) {
+			c.mu.Unlock()
+			return false
+		}
+
+		call = &crawlerCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.run(key, call, k, ip)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.verified
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// run verifies the given crawler IP for all the requests waiting for it, and caches the result.
+// The lookups are not bound to any of these requests, so that a canceled one doesn't fail the others.
+func (c *crawlers) run(key string, call *crawlerCall, k *crawler, ip netip.Addr) {
+	call.verified = c.confirm(context.Background(), k, ip)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.store(key, call.verified)
+	c.mu.Unlock()
+
+	close(call.done)
+}
+
+// cached returns the cached verification of the given key, c.mu must be held.
+func (c *crawlers) cached(key string) (verified, ok bool) {
+	e, ok := c.cache[key]
+	if !ok {
+		return false, false
+	}
+
+	entry := e.Value.(*crawlerEntry)
+	if !time.Now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.cache, key)
+		return false, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.verified, true
+}
+
+// store caches the verification of the given key, evicting the least recently used one when full, c.mu must be held.
+func (c *crawlers) store(key string, verified bool) {
+	entry := &crawlerEntry{key: key, verified: verified, expires: time.Now().Add(crawlerCacheTTL)}
+
+	if e, ok := c.cache[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.cache[key] = c.lru.PushFront(entry)
+
+	if c.lru.Len() > crawlerCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.cache, oldest.Value.(*crawlerEntry).key)
+	}
+}
+
+type crawlerBudgetKey struct{}
+
+// withCrawlerBudget returns a context allowing crawlerMaxLookups DNS verifications to the request,
+// so that a long X-Forwarded-For can't trigger a lookup per IP.
+func withCrawlerBudget(ctx context.Context) context.Context {
+	budget := int32(crawlerMaxLookups)
+	return context.WithValue(ctx, crawlerBudgetKey{}, &budget)
+}
+
+// spendCrawlerLookup returns true if the request of the given context can start a DNS verification.
+// Contexts without budget are not limited.
+func spendCrawlerLookup(ctx context.Context) bool {
+	budget, ok := ctx.Value(crawlerBudgetKey{}).(*int32)
+	if !ok {
+		return true
+	}
+
+	return atomic.AddInt32(budget, -1) >= 0
+}
+
+// confirm returns true if a reverse DNS name of the given IP belongs to the domains of the crawler
+// and resolves back to the IP (forward-confirmed reverse DNS).
+func (c *crawlers) confirm(ctx context.Context, k *crawler, ip netip.Addr) bool {
+	ctx, cancel := context.WithTimeout(ctx, crawlerTimeout)
+	defer cancel()
+
+	names, err := c.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false
+	}
+
+	if len(names) > crawlerMaxNames {
+		names = names[:crawlerMaxNames]
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !k.owns(name) {
+			continue
+		}
+
+		addrs, err := c.resolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if a, err := netip.ParseAddr(addr); err == nil && a.WithZone("").Unmap() == ip {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// owns returns true if the given host name belongs to one of the crawler domains.
+func (k *crawler) owns(name string) bool {
+	for _, domain := range k.Domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
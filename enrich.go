@@ -0,0 +1,116 @@
+package geoblock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEnrichmentPrefix is the default prefix of the enrichment headers.
+const DefaultEnrichmentPrefix = "X-Geo-"
+
+// Enrichment header names, after the prefix, in signature order.
+var enrichmentHeaders = []string{"IP", "Country", "Region", "City", "ISP", "ASN", "Decision", "Timestamp"}
+
+// Decisions forwarded in the enrichment headers.
+const (
+	decisionAllow  = "allow"
+	decisionBlock  = "block" // Only forwarded when blocking is disabled or in monitor mode.
+	decisionBypass = "bypass"
+)
+
+// strip removes the client-supplied enrichment headers from the request.
+func (e Enrichment) strip(r *http.Request) {
+	prefix := strings.ToLower(e.prefix())
+
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), prefix) {
+			r.Header.Del(k)
+		}
+	}
+}
+
+// enrich sets the enrichment headers of the request from the decision of the client IP.
+func (e Enrichment) enrich(r *http.Request, d Decision, decision string) {
+	prefix := e.prefix()
+
+	for name, v := range map[string]string{
+		"IP":        d.IP,
+		"Country":   strings.ToUpper(d.Record.Country),
+		"Region":    d.Record.Region,
+		"City":      d.Record.City,
+		"ISP":       d.Record.ISP,
+		"ASN":       d.Record.ASN,
+		"Decision":  decision,
+		"Timestamp": strconv.FormatInt(time.Now().Unix(), 10),
+	} {
+		if v != "" {
+			r.Header.Set(prefix+name, v)
+		}
+	}
+
+	if e.Secret != "" {
+		r.Header.Set(prefix+"Signature", EnrichmentSignature(r.Header, prefix, e.Secret))
+	}
+}
+
+// client returns the IP described by the enrichment headers among the collected IPs of the request.
+// Leftmost X-Forwarded-For entries are set by the client itself, the trusted entries are the rightmost ones:
+// the client is the entry before the trusted hops, or the rightmost one outside of the trusted proxies.
+// Without X-Forwarded-For, it is the first collected IP (e.g. X-Real-IP).
+func (e Enrichment) client(r *http.Request, ips []string, trusted func(ip netip.Addr) bool) string {
+	var hops []string
+	for _, ip := range strings.Split(r.Header.Get("X-Forwarded-For"), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			hops = append(hops, ip)
+		}
+	}
+
+	switch {
+	case len(hops) == 0 && len(ips) == 0:
+		return ""
+	case len(hops) == 0:
+		return ips[0]
+	case e.TrustedHops >= len(hops):
+		return hops[0]
+	case e.TrustedHops > 0:
+		return hops[len(hops)-1-e.TrustedHops]
+	}
+
+	for i := len(hops) - 1; i > 0; i-- {
+		if ip, err := netip.ParseAddr(hops[i]); err != nil || !trusted(ip) {
+			return hops[i]
+		}
+	}
+
+	return hops[0]
+}
+
+func (e Enrichment) prefix() string {
+	if e.Prefix == "" {
+		return DefaultEnrichmentPrefix
+	}
+
+	return e.Prefix
+}
+
+// EnrichmentSignature returns the hex HMAC-SHA256 signature of the enrichment headers with the given prefix.
+// The signed payload is made of a "Name: value\n" line per present header, in the order
+// IP, Country, Region, City, ISP, ASN, Decision and Timestamp, names including the prefix.
+// Backends compare it to the <prefix>Signature header with hmac.Equal and check the timestamp freshness.
+func EnrichmentSignature(h http.Header, prefix, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	for _, name := range enrichmentHeaders {
+		if v := h.Get(prefix + name); v != "" {
+			mac.Write([]byte(prefix + name + ": " + v + "\n"))
+		}
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,108 +1,550 @@
 package geoblock
 
 import (
+	"crypto/x509"
 	"fmt"
-	"net"
+	"log"
+	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 
 	"github.com/mdouchement/geoblock/lookup"
 )
 
+// A Decision is the result of the evaluation of an IP.
+type Decision struct {
+	Allowed bool
+	IP      string
+	Record  lookup.Record
+	Source  string    // Lookup vendor which answered the country.
+	Policy  string    // Name of the matched policy, empty for the default policy.
+	Rule    *Rule     // Matched rule, nil for the default action.
+	Trial   *Decision // Decision of a matched monitor rule, not enforced.
+	action  *action
+}
+
+// Action returns the action to perform.
+func (d Decision) Action() Action {
+	return d.action.Action
+}
+
+func (d Decision) answeredBy() string {
+	if d.Source == "" {
+		return ""
+	}
+
+	return " answered by " + d.Source
+}
+
+func (d Decision) matchedBy() string {
+	s := ""
+	if d.Policy != "" {
+		s = fmt.Sprintf(" in policy %q", d.Policy)
+	}
+	if d.Rule != nil {
+		s += fmt.Sprintf(" matched by %s rule %q", d.Rule.Type, d.Rule.Value)
+	}
+
+	return s + ", action " + d.action.String()
+}
+
 // An Evaluator evaluates whether an IP is allowed or blocked.
+// Closing an Evaluator closes its lookups once all in-flight evaluations are done.
 type Evaluator struct {
 	name    string
 	lookups []lookup.Lookup
 
-	fallback       string
-	allowedCIDR    []*net.IPNet
-	allowedCountry map[string]bool
-	blockedCIDR    []*net.IPNet
-	blockedCountry map[string]bool
+	mu       sync.Mutex
+	inflight int
+	closed   bool
+
+	policies []*policy // Configured policies followed by the default one.
+	monitor  bool      // Monitor mode: the monitor rules are part of the decisions.
+	trials   bool      // Some rules are monitor rules.
+
+	proxies    []netip.Prefix // Proxies trusted for the forwarded client certificate.
+	certHeader string
+	crawlers   *crawlers
+}
+
+// A policy is a validated Policy.
+type policy struct {
+	name     string
+	match    *matcher
+	fallback *action
+	allowed  ruleset
+	blocked  ruleset
+}
+
+// A ruleset holds the rules of a list.
+type ruleset struct {
+	certs    []certRule
+	crawlers []crawlerRule
+	cidrs    []cidrRule
+	fields   []lookup.Field                      // Record fields of the rules, in configuration order.
+	values   map[lookup.Field]map[string][]*rule // Rules per record field and normalized value.
+}
+
+// A rule is a validated Rule.
+type rule struct {
+	Rule
+	action *action
+	match  *matcher
+}
+
+type crawlerRule struct {
+	match func(r *http.Request, ip netip.Addr) bool
+	rule  *rule
 }
 
-// NewEvaluator returns a new Evaluator.
-func NewEvaluator(name string, c Config) (*Evaluator, error) {
+type cidrRule struct {
+	prefix netip.Prefix
+	rule   *rule
+}
+
+// Record fields matched by rule types.
+var ruleFields = map[RuleType]lookup.Field{
+	RuleTypeCountry: lookup.FieldCountry,
+	RuleTypeRegion:  lookup.FieldRegion,
+	RuleTypeASN:     lookup.FieldASN,
+}
+
+// NewEvaluator returns a new Evaluator answering from the given lookups, in order.
+// The rules are checked against the fields the lookups are able to answer: it fails when no lookup
+// answers the field of a rule and warns when only some of them do.
+func NewEvaluator(name string, c Config, lookups ...lookup.Lookup) (*Evaluator, error) {
 	e := &Evaluator{
-		name:     name,
-		fallback: c.DefaultAction,
+		name:       name,
+		lookups:    lookups,
+		monitor:    c.Mode == ModeMonitor,
+		certHeader: c.ClientCertHeader,
+	}
+	if e.certHeader == "" {
+		e.certHeader = DefaultClientCertHeader
 	}
 
 	var err error
+	if e.proxies, err = parseProxies(c.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if e.crawlers, err = newCrawlers(c.Crawlers, c.Resolver); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	for i, p := range c.Policies {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if p.DefaultAction == "" {
+			p.DefaultAction = c.DefaultAction
+		}
 
-	e.allowedCountry, e.allowedCIDR, err = e.list(c.Allowlist)
+		if err := e.addPolicy(p, c.DisallowedStatusCode); err != nil {
+			return nil, fmt.Errorf("%s: policy %q: %w", name, p.Name, err)
+		}
+	}
+
+	err = e.addPolicy(Policy{
+		DefaultAction: c.DefaultAction,
+		Allowlist:     c.Allowlist,
+		Blocklist:     c.Blocklist,
+	}, c.DisallowedStatusCode)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", name, err)
 	}
 
-	e.blockedCountry, e.blockedCIDR, err = e.list(c.Blocklist)
-	return e, err
+	return e, nil
 }
 
 // AddLookup adds a lookup to the evaluator.
+//
+// Deprecated: pass the lookups to NewEvaluator, rules are not checked against the fields of added lookups.
 func (e *Evaluator) AddLookup(l lookup.Lookup) {
 	e.lookups = append(e.lookups, l)
 }
 
-// Evaluate evaluates the state of the given IP.
-func (e *Evaluator) Evaluate(addr string) (allowed bool, country string, err error) {
-	ip := net.ParseIP(addr)
-	if ip == nil {
-		return false, "", fmt.Errorf("%s: invalid IP address: %s", e.name, addr)
+// addPolicy validates the given policy and its rules.
+func (e *Evaluator) addPolicy(p Policy, status int) error {
+	var err error
+
+	c := &policy{
+		name: p.Name,
 	}
 
-	//
+	if c.match, err = newMatcher(p.Match, false); err != nil {
+		return err
+	}
+
+	fallback := ActionType(p.DefaultAction)
+	if fallback != ActionAllow && fallback != ActionBlock {
+		return fmt.Errorf("invalid default action: %s", p.DefaultAction)
+	}
+
+	if c.fallback, err = newAction(Action{}, fallback, status, fallback); err != nil {
+		return fmt.Errorf("default %w", err)
+	}
 
-	for _, block := range e.blockedCIDR {
-		if block.Contains(ip) {
-			return false, "", nil
+	if c.allowed, err = e.list(p.Allowlist, ActionAllow, status, ActionAllow); err != nil {
+		return err
+	}
+
+	if c.blocked, err = e.list(p.Blocklist, ActionBlock, status, ActionBlock, ActionRedirect, ActionChallenge); err != nil {
+		return err
+	}
+
+	for _, r := range append(p.Allowlist, p.Blocklist...) {
+		if err = e.check(r); err != nil {
+			return err
 		}
+
+		e.trials = e.trials || (r.Monitor && !e.monitor)
 	}
 
-	for _, lookup := range e.lookups {
-		country, err = lookup.Country(ip)
-		if err != nil {
-			return false, "", fmt.Errorf("%s: country lookup: %w", e.name, err)
+	e.policies = append(e.policies, c)
+	return nil
+}
+
+// check checks the lookups are able to answer the field of the given rule.
+func (e *Evaluator) check(r Rule) error {
+	field, ok := ruleFields[r.Type]
+	if !ok || len(e.lookups) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for _, l := range e.lookups {
+		if !l.Metadata().Has(field) {
+			missing = append(missing, lookup.Describe(l))
 		}
 	}
 
-	if e.blockedCountry[country] {
-		return false, country, nil
+	if len(missing) == len(e.lookups) {
+		return fmt.Errorf("%s rule %q: no database provides the %s field", r.Type, r.Value, field)
+	}
+
+	if len(missing) > 0 {
+		log.Printf("WARNING %s: %s rule %q: the %s field is missing from %s", e.name, r.Type, r.Value, field, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Close implements the io.Closer interface.
+func (e *Evaluator) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return nil
+	}
+
+	e.closed = true
+	if e.inflight > 0 {
+		return nil
+	}
+
+	return e.close()
+}
+
+func (e *Evaluator) close() (err error) {
+	for _, l := range e.lookups {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (e *Evaluator) acquire() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return false
+	}
+
+	e.inflight++
+	return true
+}
+
+func (e *Evaluator) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.inflight--
+	if e.closed && e.inflight == 0 {
+		_ = e.close()
+	}
+}
+
+// Evaluate evaluates the state of the given IP with the rules applying to all the requests.
+func (e *Evaluator) Evaluate(addr string) (Decision, error) {
+	return e.EvaluateRequest(nil, addr)
+}
+
+// EvaluateRequest evaluates the state of the given IP of the request.
+// The rules of the first policy matching the request apply, rules restricted to other requests are skipped.
+func (e *Evaluator) EvaluateRequest(r *http.Request, addr string) (Decision, error) {
+	p := e.policy(r)
+
+	d := Decision{
+		IP:     addr,
+		Policy: p.name,
+		action: p.fallback,
+	}
+
+	if !e.acquire() {
+		return d, fmt.Errorf("%s: evaluator closed", e.name)
+	}
+	defer e.release()
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return d, fmt.Errorf("%s: invalid IP address: %s", e.name, addr)
+	}
+	ip = ip.WithZone("").Unmap()
+
+	var cert *x509.Certificate
+	if len(p.allowed.certs) > 0 || len(p.blocked.certs) > 0 {
+		if cert, err = e.certificate(r); err != nil {
+			return d, fmt.Errorf("%s: client certificate: %w", e.name, err)
+		}
 	}
 
 	//
 
-	for _, block := range e.allowedCIDR {
-		if block.Contains(ip) {
-			return true, country, nil
+	// Blocked networks are not looked up, unless a client certificate or a monitor rule could decide otherwise.
+	if rule := p.blocked.matchIP(r, ip, e.monitor); rule != nil && cert == nil && !e.trials {
+		return d.match(rule, false), nil
+	}
+
+	// Fields are answered by the first lookup knowing them, overrides answer for the whole record.
+	for _, l := range e.lookups {
+		record, err := l.Record(ip)
+		if err != nil {
+			return d, fmt.Errorf("%s: country lookup: %w", e.name, err)
+		}
+
+		vendor := l.Metadata().Vendor
+		if vendor == lookup.VendorOverride && record != (lookup.Record{}) {
+			d.Record = record
+			d.Source = strings.ToLower(vendor)
+			break
+		}
+
+		if d.Record.Country == "" && record.Country != "" {
+			d.Source = strings.ToLower(vendor)
 		}
+
+		d.Record.Merge(record)
 	}
 
-	if e.allowedCountry[country] {
-		return true, country, nil
+	enforced := p.decide(r, d, ip, cert, e.monitor)
+	if e.trials {
+		if trial := p.decide(r, d, ip, cert, true); trial.Rule != nil && trial.Rule.Monitor {
+			enforced.Trial = &trial
+		}
 	}
 
-	return e.fallback == DefaultActionAllow, country, nil
+	return enforced, nil
 }
 
-func (e *Evaluator) list(list []Rule) (map[string]bool, []*net.IPNet, error) {
-	countries := make(map[string]bool)
-	blocks := make([]*net.IPNet, 0)
+// policy returns the first policy matching the given request.
+func (e *Evaluator) policy(r *http.Request) *policy {
+	for _, p := range e.policies[:len(e.policies)-1] {
+		if p.match.match(r) {
+			return p
+		}
+	}
+
+	return e.policies[len(e.policies)-1]
+}
+
+// decide applies the rules to the given looked up decision, monitor rules are skipped unless monitor is set.
+// Client certificate rules apply first, then the verified crawler rules outside of the blocked networks,
+// regardless of the location.
+func (p *policy) decide(r *http.Request, d Decision, ip netip.Addr, cert *x509.Certificate, monitor bool) Decision {
+	if rule := p.blocked.matchCert(r, cert, monitor); rule != nil {
+		return d.match(rule, false)
+	}
+
+	if rule := p.allowed.matchCert(r, cert, monitor); rule != nil {
+		return d.match(rule, true)
+	}
+
+	//
+
+	if rule := p.blocked.matchIP(r, ip, monitor); rule != nil {
+		return d.match(rule, false)
+	}
+
+	if rule := p.blocked.matchCrawler(r, ip, monitor); rule != nil {
+		return d.match(rule, false)
+	}
+
+	if rule := p.allowed.matchCrawler(r, ip, monitor); rule != nil {
+		return d.match(rule, true)
+	}
+
+	if rule := p.blocked.matchRecord(r, d.Record, monitor); rule != nil {
+		return d.match(rule, false)
+	}
+
+	//
+
+	if rule := p.allowed.matchIP(r, ip, monitor); rule != nil {
+		return d.match(rule, true)
+	}
+
+	if rule := p.allowed.matchRecord(r, d.Record, monitor); rule != nil {
+		return d.match(rule, true)
+	}
+
+	d.Allowed = p.fallback.Type == ActionAllow
+	return d
+}
+
+func (d Decision) match(r *rule, allowed bool) Decision {
+	d.Allowed = allowed
+	d.Rule = &r.Rule
+	d.action = r.action
+	return d
+}
+
+func (e *Evaluator) list(list []Rule, fallback ActionType, status int, actions ...ActionType) (ruleset, error) {
+	s := ruleset{
+		values: make(map[lookup.Field]map[string][]*rule),
+	}
 
 	for _, r := range list {
+		a, err := newAction(r.Action, fallback, status, actions...)
+		if err != nil {
+			return ruleset{}, fmt.Errorf("%s rule %q: %w", r.Type, r.Value, err)
+		}
+
+		m, err := newMatcher(r.Match, false)
+		if err != nil {
+			return ruleset{}, fmt.Errorf("%s rule %q: %w", r.Type, r.Value, err)
+		}
+
+		compiled := &rule{
+			Rule:   r,
+			action: a,
+			match:  m,
+		}
+
+		if field, ok := ruleFields[r.Type]; ok {
+			if s.values[field] == nil {
+				s.values[field] = make(map[string][]*rule)
+				s.fields = append(s.fields, field)
+			}
+
+			v := normalize(field, r.Value)
+			s.values[field][v] = append(s.values[field][v], compiled)
+			continue
+		}
+
 		switch r.Type {
-		case RuleTypeCountry:
-			countries[strings.ToLower(r.Value)] = true
+		case RuleTypeCert:
+			match, err := certMatcher(r.Value)
+			if err != nil {
+				return ruleset{}, fmt.Errorf("%s rule %q: %w", r.Type, r.Value, err)
+			}
+
+			s.certs = append(s.certs, certRule{match: match, rule: compiled})
+		case RuleTypeCrawler:
+			k, err := e.crawlers.get(r.Value)
+			if err != nil {
+				return ruleset{}, fmt.Errorf("%s rule %q: %w", r.Type, r.Value, err)
+			}
+
+			s.crawlers = append(s.crawlers, crawlerRule{
+				match: func(r *http.Request, ip netip.Addr) bool {
+					return e.crawlers.verify(r, k, ip)
+				},
+				rule: compiled,
+			})
 		case RuleTypeCIDR:
-			_, block, err := net.ParseCIDR(r.Value)
+			block, err := netip.ParsePrefix(r.Value)
 			if err != nil {
-				return nil, nil, fmt.Errorf("%s: invalid rule type: %s", e.name, r.Type)
+				return ruleset{}, fmt.Errorf("invalid rule type: %s", r.Type)
 			}
 
-			blocks = append(blocks, block)
+			s.cidrs = append(s.cidrs, cidrRule{prefix: block.Masked(), rule: compiled})
 		default:
-			return nil, nil, fmt.Errorf("%s: invalid rule type: %s", e.name, r.Type)
+			return ruleset{}, fmt.Errorf("invalid rule type: %s", r.Type)
+		}
+	}
+
+	return s, nil
+}
+
+// matchCert returns the first cert rule matching the given client certificate, monitor rules are skipped unless monitor is set.
+func (s ruleset) matchCert(r *http.Request, cert *x509.Certificate, monitor bool) *rule {
+	if cert == nil {
+		return nil
+	}
+
+	for _, c := range s.certs {
+		if c.match(cert) && c.rule.applies(r, monitor) {
+			return c.rule
 		}
 	}
 
-	return countries, blocks, nil
+	return nil
+}
+
+// matchCrawler returns the first crawler rule verifying the given request, monitor rules are skipped unless monitor is set.
+func (s ruleset) matchCrawler(r *http.Request, ip netip.Addr, monitor bool) *rule {
+	for _, c := range s.crawlers {
+		if c.rule.applies(r, monitor) && c.match(r, ip) {
+			return c.rule
+		}
+	}
+
+	return nil
+}
+
+// matchIP returns the first CIDR rule containing the given IP, monitor rules are skipped unless monitor is set.
+func (s ruleset) matchIP(r *http.Request, ip netip.Addr, monitor bool) *rule {
+	for _, block := range s.cidrs {
+		if block.prefix.Contains(ip) && block.rule.applies(r, monitor) {
+			return block.rule
+		}
+	}
+
+	return nil
+}
+
+// matchRecord returns the first rule matching a field of the given record, monitor rules are skipped unless monitor is set.
+func (s ruleset) matchRecord(r *http.Request, record lookup.Record, monitor bool) *rule {
+	for _, field := range s.fields {
+		if v := record.Get(field); v != "" {
+			for _, rule := range s.values[field][normalize(field, v)] {
+				if rule.applies(r, monitor) {
+					return rule
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// applies returns true if the rule applies to the given request.
+func (r *rule) applies(req *http.Request, monitor bool) bool {
+	return (monitor || !r.Monitor) && r.match.match(req)
+}
+
+// normalize returns the comparable form of a field value: case insensitive and ASNs without AS prefix.
+func normalize(field lookup.Field, v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if field == lookup.FieldASN {
+		v = strings.TrimPrefix(v, "as")
+	}
+
+	return v
 }
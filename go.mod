@@ -5,11 +5,11 @@ go 1.22
 require (
 	github.com/ip2location/ip2location-go/v9 v9.7.1
 	github.com/stretchr/testify v1.7.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	lukechampine.com/uint128 v1.3.0 // indirect
 )
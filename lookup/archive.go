@@ -0,0 +1,147 @@
+package lookup
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// MaxExtractSize is the maximum size in bytes of a database extracted from an archive,
+// larger entries (e.g. decompression bombs) are rejected.
+const MaxExtractSize int64 = 2 << 30
+
+// IsArchive returns true if the given database name is a supported archive.
+func IsArchive(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip", ".gz":
+		return true
+	}
+
+	return false
+}
+
+// ExtractFile extracts a database from the given archive file.
+// See Extract for the entry selection.
+func ExtractFile(name, entry string) ([]byte, string, error) {
+	return Spec{Name: name, Entry: entry}.extract()
+}
+
+// extract extracts the database of the given archive spec, see openFile.
+func (s Spec) extract() ([]byte, string, error) {
+	payload, err := s.readFile(s.Name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return Extract(s.Name, payload, s.Entry)
+}
+
+// Extract extracts a database from the given archive payload, name is used to detect the archive format.
+// For zip archives, the entry is selected by its name or defaults to the only .bin, .csv or .gbdb entry.
+// It returns the database and its entry name.
+func Extract(name string, payload []byte, entry string) ([]byte, string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: creating gzip reader: %w", name, err)
+		}
+		defer r.Close()
+
+		payload, err = extract(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: decompressing: %w", name, err)
+		}
+
+		if entry == "" {
+			entry = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		}
+
+		return payload, entry, nil
+	case ".zip":
+		codec, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: creating zip reader: %w", name, err)
+		}
+
+		file, err := zipEntry(codec, entry)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", name, err)
+		}
+
+		if file.UncompressedSize64 > uint64(MaxExtractSize) {
+			return nil, "", fmt.Errorf("%s: decompressing %s: %w", name, file.Name, errExtractSize)
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: opening zip entry %s: %w", name, file.Name, err)
+		}
+		defer r.Close()
+
+		payload, err = extract(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: decompressing %s: %w", name, file.Name, err)
+		}
+
+		return payload, file.Name, nil
+	}
+
+	return nil, "", fmt.Errorf("%s: unsupported archive format", name)
+}
+
+var errExtractSize = fmt.Errorf("database larger than %d bytes", MaxExtractSize)
+
+// extract reads a decompressed database of at most MaxExtractSize bytes.
+// Sizes declared by the archive are not trusted.
+func extract(r io.Reader) ([]byte, error) {
+	payload, err := io.ReadAll(io.LimitReader(r, MaxExtractSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(payload)) > MaxExtractSize {
+		return nil, errExtractSize
+	}
+
+	return payload, nil
+}
+
+func zipEntry(codec *zip.Reader, entry string) (*zip.File, error) {
+	var found *zip.File
+
+	for _, file := range codec.File {
+		if entry != "" {
+			if file.Name == entry {
+				return file, nil
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".bin") && !isCSV(file.Name) && !strings.HasSuffix(strings.ToLower(file.Name), CompactExt) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("several databases found in archive (%s, %s), select one with #ENTRY", found.Name, file.Name)
+		}
+
+		found = file
+	}
+
+	if entry != "" {
+		return nil, fmt.Errorf("entry not found in archive: %s", entry)
+	}
+
+	if found == nil {
+		return nil, errors.New("no database found in archive")
+	}
+
+	return found, nil
+}
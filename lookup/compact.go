@@ -0,0 +1,393 @@
+package lookup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Geoblock compact database format.
+const (
+	VendorGeoblock = "Geoblock"
+	CompactMagic   = "GEOBLOCK"
+	CompactVersion = 1
+	CompactExt     = ".gbdb"
+)
+
+// A compact database holds merged country ranges (see table), all integers are big endian:
+//
+//	magic     [8]byte  "GEOBLOCK"
+//	version   uint16
+//	date      int64    Build date of the source database (unix time, 0 when unknown).
+//	source    uint16   Length, followed by the source database description.
+//	checksum  [32]byte SHA-256 of the body.
+//	body:
+//	countries uint16   Count, followed by the 2-letter codes (lowercased, "--" for private addresses).
+//	ipv4      uint32   Count, followed by the uint32 start addresses and the uint16 country indexes.
+//	ipv6      uint32   Count, followed by the [16]byte start addresses and the uint16 country indexes.
+//
+// The first country (index 0) is implicit and marks the unknown ranges.
+// As in IPv6 ip2location databases, 6to4 and Teredo addresses are looked up as IPv4 when IPv6 ranges are present.
+
+// isCompact returns true if the given payload is a compact database.
+func isCompact(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(CompactMagic))
+}
+
+// OpenCompact opens a compact database and returns a Lookup.
+func OpenCompact(name string) (Lookup, error) {
+	payload, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openCompact(payload, OriginFilesystem, name)
+}
+
+// OpenCompactReader reads a compact database and returns a Lookup.
+func OpenCompactReader(r io.Reader) (Lookup, error) {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return openCompact(payload, OriginReader, "")
+}
+
+func openCompact(payload []byte, origin, name string) (Lookup, error) {
+	r := bytes.NewReader(payload)
+
+	var header struct {
+		Magic   [8]byte
+		Version uint16
+		Date    int64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("reading compact header: %w", err)
+	}
+
+	if string(header.Magic[:]) != CompactMagic {
+		return nil, errors.New("invalid compact database")
+	}
+	if header.Version != CompactVersion {
+		return nil, fmt.Errorf("unsupported compact database version: %d", header.Version)
+	}
+
+	source, err := readCompactString(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading compact header: %w", err)
+	}
+
+	var checksum [sha256.Size]byte
+	if _, err = io.ReadFull(r, checksum[:]); err != nil {
+		return nil, fmt.Errorf("reading compact header: %w", err)
+	}
+
+	body := payload[len(payload)-r.Len():]
+	if sha256.Sum256(body) != checksum {
+		return nil, errors.New("compact database checksum mismatch")
+	}
+
+	//
+
+	meta := Metadata{
+		Vendor:  VendorGeoblock,
+		Edition: fmt.Sprintf("v%d", header.Version),
+		Source:  source,
+		Origin:  origin,
+		Name:    name,
+	}
+	if header.Date != 0 {
+		meta.BuildDate = time.Unix(header.Date, 0).UTC()
+	}
+
+	t := newTable(meta)
+	if err = t.read(r); err != nil {
+		return nil, fmt.Errorf("reading compact database: %w", err)
+	}
+
+	return t.build(), nil
+}
+
+// read reads the body of a compact database.
+// Counts are validated against the remaining payload before allocating.
+func (t *table) read(r *bytes.Reader) error {
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+
+	if err := remains(r, uint64(count), 2); err != nil {
+		return fmt.Errorf("countries: %w", err)
+	}
+
+	codes := make([]byte, 2*int(count))
+	if _, err := io.ReadFull(r, codes); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(codes); i += 2 {
+		country := string(codes[i : i+2])
+		if country == "--" {
+			country = PrivateAddress
+		}
+
+		t.countries = append(t.countries, country)
+	}
+
+	//
+
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+
+	if err := remains(r, uint64(n), 4+2); err != nil {
+		return fmt.Errorf("ipv4 ranges: %w", err)
+	}
+
+	t.v4 = make([]uint32, n)
+	t.v4country = make([]uint16, n)
+	if err := binary.Read(r, binary.BigEndian, t.v4); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, t.v4country); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+
+	if err := remains(r, uint64(n), 16+2); err != nil {
+		return fmt.Errorf("ipv6 ranges: %w", err)
+	}
+
+	t.v6 = make([][2]uint64, n)
+	t.v6country = make([]uint16, n)
+	if err := binary.Read(r, binary.BigEndian, t.v6); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, t.v6country); err != nil {
+		return err
+	}
+
+	for _, c := range append(t.v4country, t.v6country...) {
+		if int(c) >= len(t.countries) {
+			return fmt.Errorf("invalid country index: %d", c)
+		}
+	}
+
+	return nil
+}
+
+// remains checks that count records of the given size remain to be read.
+func remains(r *bytes.Reader, count, size uint64) error {
+	if count*size > uint64(r.Len()) {
+		return fmt.Errorf("%d records exceed the payload", count)
+	}
+
+	return nil
+}
+
+// write writes a compact database.
+func (t *table) write(w io.Writer) error {
+	var body bytes.Buffer
+
+	codes := make([]byte, 0, 2*len(t.countries))
+	for _, country := range t.countries[1:] {
+		if country == PrivateAddress {
+			country = "--"
+		}
+
+		if len(country) != 2 {
+			return fmt.Errorf("invalid country code: %q", country)
+		}
+
+		codes = append(codes, strings.ToLower(country)...)
+	}
+
+	for _, v := range []interface{}{
+		uint16(len(t.countries) - 1), codes,
+		uint32(len(t.v4)), t.v4, t.v4country,
+		uint32(len(t.v6)), t.v6, t.v6country,
+	} {
+		if err := binary.Write(&body, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	//
+
+	source := t.meta.Source
+	if len(source) > 0xffff {
+		source = source[:0xffff]
+	}
+
+	var date int64
+	if !t.meta.BuildDate.IsZero() {
+		date = t.meta.BuildDate.Unix()
+	}
+
+	var header bytes.Buffer
+	for _, v := range []interface{}{
+		[]byte(CompactMagic), uint16(CompactVersion), date,
+		uint16(len(source)), []byte(source),
+		sha256.Sum256(body.Bytes()),
+	} {
+		if err := binary.Write(&header, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	if _, err := header.WriteTo(w); err != nil {
+		return err
+	}
+
+	_, err := body.WriteTo(w)
+	return err
+}
+
+func readCompactString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Convert writes the given database spec as a compact database.
+// ip2location (BIN), CSV, RIR and MaxMind DB (.mmdb) databases are supported, only countries are kept.
+func Convert(w io.Writer, s string) error {
+	spec, err := ParseSpec(s)
+	if err != nil {
+		return err
+	}
+
+	spec, _, err = spec.verify()
+	if err != nil {
+		return err
+	}
+	defer spec.release()
+
+	var t *table
+	if isMMDB(spec.Name) {
+		t, err = compileMMDB(spec)
+	} else {
+		t, err = compile(spec)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec.Name, err)
+	}
+
+	return t.write(w)
+}
+
+// compile compiles the given database spec into a table.
+func compile(spec Spec) (*table, error) {
+	spec.Options.Set(OptionInMemory, "true")
+
+	l, err := open(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	meta := l.Metadata()
+	meta.Source = source(meta)
+
+	switch l := l.(type) {
+	case *table:
+		t := *l
+		t.meta = meta
+		return &t, nil
+	case *csvdb:
+		return l.ranges.table(meta)
+	case *rir:
+		return l.ranges.table(meta)
+	}
+
+	return nil, fmt.Errorf("unsupported database: %s", Describe(l))
+}
+
+// compileMMDB compiles the countries of a MaxMind DB database into a table.
+func compileMMDB(spec Spec) (*table, error) {
+	name := spec.Name
+
+	payload, err := spec.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := parseMMDB(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := Metadata{
+		Vendor:    VendorMaxMind,
+		Edition:   db.dbtype,
+		BuildDate: db.builddate,
+		Name:      name,
+	}
+	meta.Source = source(meta)
+
+	t := newTable(meta)
+	countries := make(map[uint]string) // Records are shared by many networks.
+
+	err = db.walk(func(network netip.Prefix, offset uint) error {
+		country, ok := countries[offset]
+		if !ok {
+			var err error
+			if country, err = db.country(offset); err != nil {
+				return err
+			}
+
+			countries[offset] = country
+		}
+
+		return t.span(network.Addr(), lastAddr(network), country)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t.build(), nil
+}
+
+// table converts the ranges to a table.
+func (r ranges) table(meta Metadata) (*table, error) {
+	t := newTable(meta)
+
+	for _, s := range r {
+		if err := t.span(s.from, s.to, s.country); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.build(), nil
+}
+
+// source describes the given source database.
+func source(m Metadata) string {
+	s := strings.TrimSpace(m.Vendor + " " + m.Edition)
+	if m.Name != "" {
+		s += " " + filepath.Base(m.Name)
+	}
+
+	return s
+}
@@ -0,0 +1,195 @@
+package lookup_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+
+	csv := filepath.Join(dir, "countries.csv")
+	err := os.WriteFile(csv, []byte(`1.0.0.0,1.0.0.255,AU
+1.1.1.0,1.1.1.127,US
+1.1.1.128,1.1.1.255,US
+80.67.169.0,80.67.169.255,FR
+2001:910::,2001:910:ffff:ffff:ffff:ffff:ffff:ffff,FR
+`), 0o600)
+	assert.NoError(t, err)
+
+	mmdb := filepath.Join(dir, "countries.mmdb")
+	err = os.WriteFile(mmdb, buildMMDB(t, map[string]string{
+		"1.0.0.0/24":     "AU",
+		"1.1.1.0/24":     "US",
+		"80.67.169.0/24": "FR",
+		"2001:910::/32":  "FR",
+	}), 0o600)
+	assert.NoError(t, err)
+
+	for _, database := range []string{csv, mmdb} {
+		var buf bytes.Buffer
+		err := lookup.Convert(&buf, database)
+		if !assert.NoError(t, err, database) {
+			continue
+		}
+
+		l, err := lookup.OpenCompactReader(bytes.NewReader(buf.Bytes()))
+		if !assert.NoError(t, err, database) {
+			continue
+		}
+
+		meta := l.Metadata()
+		assert.Equal(t, lookup.VendorGeoblock, meta.Vendor)
+		assert.Equal(t, []string{lookup.FamilyIPv4, lookup.FamilyIPv6}, meta.Families)
+		assert.Contains(t, meta.Source, filepath.Base(database))
+
+		for ip, country := range map[string]string{
+			"1.0.0.12":            "au",
+			"1.1.1.1":             "us",
+			"1.1.1.200":           "us",
+			"1.1.2.1":             "",
+			"80.67.169.12":        "fr",
+			"::ffff:80.67.169.12": "fr",
+			"2001:910:800::12":    "fr",
+			"2001:911::12":        "",
+		} {
+			record, err := l.Record(netip.MustParseAddr(ip))
+			assert.NoError(t, err)
+			assert.Equal(t, country, record.Country, "%s: %s", database, ip)
+		}
+	}
+
+	//
+
+	var buf bytes.Buffer
+	err = lookup.Convert(&buf, csv)
+	assert.NoError(t, err)
+
+	compact := filepath.Join(dir, "countries"+lookup.CompactExt)
+	err = os.WriteFile(compact, buf.Bytes(), 0o600)
+	assert.NoError(t, err)
+
+	l, err := lookup.Open(compact)
+	if assert.NoError(t, err) {
+		assert.Contains(t, lookup.Describe(l), "geoblock v1 filesystem")
+		assert.Equal(t, 8, l.Metadata().Records) // Merged US ranges, followed by gaps.
+	}
+
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	_, err = lookup.OpenCompactReader(bytes.NewReader(corrupted))
+	assert.EqualError(t, err, "compact database checksum mismatch")
+
+	future := append([]byte(nil), buf.Bytes()...)
+	future[9] = 2
+	_, err = lookup.OpenCompactReader(bytes.NewReader(future))
+	assert.EqualError(t, err, "unsupported compact database version: 2")
+
+	forged := append([]byte(nil), buf.Bytes()...)
+	body := 8 + 2 + 8 + 2 + int(binary.BigEndian.Uint16(forged[18:])) + sha256.Size
+	countries := int(binary.BigEndian.Uint16(forged[body:]))
+	binary.BigEndian.PutUint32(forged[body+2+2*countries:], 0xffffffff)
+	checksum := sha256.Sum256(forged[body:])
+	copy(forged[body-sha256.Size:], checksum[:])
+	_, err = lookup.OpenCompactReader(bytes.NewReader(forged))
+	assert.EqualError(t, err, "reading compact database: ipv4 ranges: 4294967295 records exceed the payload")
+}
+
+// buildMMDB builds an IPv6 MaxMind DB database with 24-bit records mapping networks to countries.
+func buildMMDB(t *testing.T, networks map[string]string) []byte {
+	t.Helper()
+
+	type node struct {
+		records [2]int // Node index, -1 when empty or -2-offset for data.
+	}
+
+	nodes := []node{{records: [2]int{-1, -1}}}
+	var data []byte
+	offsets := make(map[string]int)
+
+	for network, country := range networks {
+		prefix := netip.MustParsePrefix(network)
+		addr, bits := prefix.Addr().As16(), prefix.Bits()
+		if prefix.Addr().Is4() {
+			bits += 96
+		}
+
+		offset, ok := offsets[country]
+		if !ok {
+			offset = len(data)
+			offsets[country] = offset
+			data = append(data, 0xe1, 0x47)
+			data = append(data, "country"...)
+			data = append(data, 0xe1, 0x48)
+			data = append(data, "iso_code"...)
+			data = append(data, 0x42)
+			data = append(data, country...)
+		}
+
+		if prefix.Addr().Is4() {
+			addr = [16]byte{}
+			b := prefix.Addr().As4()
+			copy(addr[12:], b[:])
+		}
+
+		n := 0
+		for depth := 0; depth < bits; depth++ {
+			bit := addr[depth/8] >> (7 - depth%8) & 1
+			if depth == bits-1 {
+				nodes[n].records[bit] = -2 - offset
+				break
+			}
+
+			if nodes[n].records[bit] < 0 {
+				nodes = append(nodes, node{records: [2]int{-1, -1}})
+				nodes[n].records[bit] = len(nodes) - 1
+			}
+			n = nodes[n].records[bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, r := range n.records {
+			v := r
+			switch {
+			case r == -1:
+				v = len(nodes)
+			case r < -1:
+				v = len(nodes) + 16 + (-2 - r)
+			}
+
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+
+	buf.WriteByte(0xe5) // Map of 5 entries
+	for _, kv := range []struct {
+		key   string
+		value []byte
+	}{
+		{key: "node_count", value: append([]byte{0xc4}, binary.BigEndian.AppendUint32(nil, uint32(len(nodes)))...)},
+		{key: "record_size", value: []byte{0xa1, 24}},
+		{key: "ip_version", value: []byte{0xa1, 6}},
+		{key: "database_type", value: append([]byte{0x40 | 12}, "Test-Country"...)},
+		{key: "build_epoch", value: append([]byte{0x08, 0x02}, binary.BigEndian.AppendUint64(nil, 1714521600)...)},
+	} {
+		buf.WriteByte(0x40 | byte(len(kv.key)))
+		buf.WriteString(kv.key)
+		buf.Write(kv.value)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,221 @@
+package lookup
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"strings"
+
+	"github.com/ip2location/ip2location-go/v9"
+)
+
+// iptools converts the decimal IPs of CSV databases.
+var iptools = ip2location.OpenTools()
+
+// A csvdb is a Lookup backed by a CSV database loaded in memory.
+type csvdb struct {
+	ranges ranges
+	meta   Metadata
+}
+
+// OpenCSV opens a CSV database and returns a Lookup.
+// See OpenCSVReader for the supported format.
+func OpenCSV(name string) (Lookup, error) {
+	return openCSVSpec(Spec{Name: name})
+}
+
+func openCSVSpec(spec Spec) (Lookup, error) {
+	f, err := spec.openFile(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return openCSV(f, OriginFilesystem, spec.Name)
+}
+
+// OpenCSVReader reads a CSV database and returns a Lookup.
+// Records are formatted as `ip_from,ip_to,country_code,...` where addresses are either
+// textual or decimal integers (e.g. IP2Location LITE, DB-IP or IPAM exports).
+// Ranges must be sorted and must not overlap.
+func OpenCSVReader(r io.Reader) (Lookup, error) {
+	return openCSV(r, OriginReader, "")
+}
+
+func openCSV(r io.Reader, origin, name string) (Lookup, error) {
+	codec := csv.NewReader(r)
+	codec.FieldsPerRecord = -1
+
+	// The family of decimal ranges is known once all the ranges are read.
+	var records [][]string
+	var rows []int
+
+	for {
+		record, err := codec.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading csv: %w", err)
+		}
+
+		line, _ := codec.FieldPos(0)
+		records = append(records, record)
+		rows = append(rows, line)
+	}
+	family := CSVFamily(records)
+
+	var spans []span
+	var lines []int
+
+	for i, record := range records {
+		line := rows[i]
+
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 columns, got %d", line, len(record))
+		}
+
+		from, to, err := ParseRange(record[0], record[1], family)
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		country := strings.ToLower(strings.TrimSpace(record[2]))
+		if country == "-" || country == "" {
+			country = PrivateAddress
+		}
+
+		spans = append(spans, span{
+			from:    from,
+			to:      to,
+			country: country,
+		})
+		lines = append(lines, line)
+	}
+
+	ranges, err := newRanges(spans, func(i int) string {
+		return fmt.Sprintf("line %d", lines[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &csvdb{
+		ranges: ranges,
+		meta: Metadata{
+			Vendor:   "CSV",
+			Families: ranges.families(),
+			Records:  len(ranges),
+			Fields:   []Field{FieldCountry},
+			Origin:   origin,
+			Name:     name,
+		},
+	}, nil
+}
+
+func (l *csvdb) Record(ip netip.Addr) (Record, error) {
+	if !ip.IsValid() {
+		return Record{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	s, ok := l.ranges.find(ip)
+	if !ok {
+		return Record{}, nil
+	}
+
+	return Record{Country: s.country}, nil
+}
+
+func (l *csvdb) Metadata() Metadata {
+	return l.meta
+}
+
+func (l *csvdb) Close() error {
+	return nil
+}
+
+// ParseRange parses a textual or decimal IP range, as found in CSV databases.
+// Decimal ranges are IPv4 or IPv6 integers depending on the given family (see CSVFamily)
+// and IPv4-mapped IPv6 ranges are unmapped.
+func ParseRange(from, to, family string) (netip.Addr, netip.Addr, error) {
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+
+	var a, b netip.Addr
+	var err error
+
+	if strings.ContainsAny(from+to, ".:") {
+		if a, err = netip.ParseAddr(from); err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+
+		if b, err = netip.ParseAddr(to); err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+	} else {
+		if a, err = decimalIP(from, family); err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+
+		if b, err = decimalIP(to, family); err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+	}
+
+	if a.Is4In6() && b.Is4In6() || a.Is4() && b.Is4() {
+		return a.Unmap(), b.Unmap(), nil
+	}
+
+	// Ranges across the IPv4-mapped block stay IPv6.
+	return netip.AddrFrom16(a.As16()), netip.AddrFrom16(b.As16()), nil
+}
+
+// CSVFamily returns the address family of the decimal ranges of the given CSV records:
+// IPv6 when a range ends after 255.255.255.255 (e.g. IP2Location IPv6 databases), IPv4 otherwise.
+func CSVFamily(records [][]string) string {
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+
+		n, ok := new(big.Int).SetString(strings.TrimSpace(record[1]), 10)
+		if ok && n.BitLen() > 32 {
+			return FamilyIPv6
+		}
+	}
+
+	return FamilyIPv4
+}
+
+// decimalIP parses the given decimal IP of the given family.
+func decimalIP(s, family string) (netip.Addr, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("invalid decimal IP: %q", s)
+	}
+
+	var ip string
+	var err error
+	if family == FamilyIPv6 {
+		ip, err = iptools.DecimalToIPv6(n)
+	} else {
+		ip, err = iptools.DecimalToIPv4(n)
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid decimal %s: %q", family, s)
+	}
+
+	return netip.ParseAddr(ip)
+}
+
+// isCSV returns true if the given database name is a CSV file.
+func isCSV(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".csv")
+}
@@ -0,0 +1,130 @@
+package lookup_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenCSVReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		lookups map[string]string
+		err     string
+	}{
+		{
+			name: "decimal IPv4",
+			csv: `"0","16777215","-","-"
+"16843008","16843263","US","United States of America"
+"1347791104","1347791359","FR","France"
+`,
+			lookups: map[string]string{
+				"0.0.0.1":      lookup.PrivateAddress,
+				"1.1.1.1":      "us",
+				"80.85.169.12": "fr",
+				"80.85.170.12": "",
+				"2001:910::12": "",
+			},
+		},
+		{
+			name: "decimal IPv6 with IPv4-mapped ranges",
+			csv: `ip_from,ip_to,country_code,country_name
+"0","281470681743359","-","-"
+"281470698586368","281470698586623","US","United States of America"
+"42540671971312875853813573447265026048","42540672050541038368077911040808976383","FR","France"
+`,
+			lookups: map[string]string{
+				"1.1.1.1":          "us",
+				"::ffff:1.1.1.1":   "us",
+				"::1":              lookup.PrivateAddress,
+				"2001:910:800::12": "fr",
+				"2001:911::12":     "",
+			},
+		},
+		{
+			name: "decimal IPv6 with IPv4-compatible ranges",
+			csv: `"0","4294967295","-","-"
+"281470698586368","281470698586623","US","United States of America"
+"42540671971312875853813573447265026048","42540672050541038368077911040808976383","FR","France"
+`,
+			lookups: map[string]string{
+				"::1":              lookup.PrivateAddress,
+				"::1.0.0.1":        lookup.PrivateAddress,
+				"1.0.0.1":          "",
+				"1.1.1.1":          "us",
+				"2001:910:800::12": "fr",
+			},
+		},
+		{
+			name: "textual",
+			csv: `1.0.0.0,1.0.0.255,AU
+80.67.169.0,80.67.169.255,FR
+2001:910::,2001:910:ffff:ffff:ffff:ffff:ffff:ffff,FR
+`,
+			lookups: map[string]string{
+				"1.0.0.12":         "au",
+				"80.67.169.12":     "fr",
+				"2001:910:800::12": "fr",
+			},
+		},
+		{
+			name: "overlapping",
+			csv: `1.0.0.0,1.0.0.255,AU
+1.0.0.128,1.0.1.255,CN
+`,
+			err: "line 2: range 1.0.0.128-1.0.1.255 overlaps 1.0.0.0-1.0.0.255 (line 1)",
+		},
+		{
+			name: "unsorted",
+			csv: `80.67.169.0,80.67.169.255,FR
+1.0.0.0,1.0.0.255,AU
+`,
+			err: "line 2: unsorted range",
+		},
+		{
+			name: "invalid",
+			csv: `1.0.0.0,1.0.0.255,AU
+1.0.1.0,1.0.1.x,AU
+`,
+			err: "line 2:",
+		},
+	}
+
+	for _, test := range tests {
+		l, err := lookup.OpenCSVReader(strings.NewReader(test.csv))
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, test.name)
+			continue
+		}
+		if !assert.NoError(t, err, test.name) {
+			continue
+		}
+
+		for ip, expected := range test.lookups {
+			record, err := l.Record(netip.MustParseAddr(ip))
+			assert.NoError(t, err, test.name)
+			assert.Equal(t, expected, record.Country, test.name+": "+ip)
+		}
+	}
+}
+
+func TestOpen_CSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ipam.csv")
+	err := os.WriteFile(filename, []byte("80.67.169.0,80.67.169.255,FR\n"), 0o644)
+	assert.NoError(t, err)
+
+	l, err := lookup.Open(filename)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	record, err := l.Record(netip.MustParseAddr("80.67.169.12"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fr", record.Country)
+	assert.Equal(t, []string{lookup.FamilyIPv4}, l.Metadata().Families)
+}
@@ -0,0 +1,91 @@
+package lookup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EmbeddedScheme is the prefix used to explicitly select a database embedded in the code.
+const EmbeddedScheme = "embedded:"
+
+// assets returns the named database embedded in the code.
+// It is set by the generated assets.go file (see .tools/ip2location-ascode).
+var assets func(name string) ([]byte, error)
+
+var embedded = struct {
+	sync.Mutex
+	assets map[string]*asset
+}{
+	assets: make(map[string]*asset),
+}
+
+// An asset is a lazily decompressed embedded database shared by all the lookups.
+type asset struct {
+	once    sync.Once
+	payload []byte
+	digest  string // SHA-256 hex digest of the payload.
+	err     error
+}
+
+// A memory is an in-memory database reader.
+type memory struct {
+	*bytes.Reader
+}
+
+func (memory) Close() error {
+	return nil
+}
+
+// Embedded returns the embedded database for the given name.
+// Names are either prefixed by EmbeddedScheme or bare filenames.
+func Embedded(name string) ([]byte, error) {
+	a, err := embeddedAsset(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.payload, nil
+}
+
+func embeddedAsset(name string) (*asset, error) {
+	name, ok := embeddedName(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+
+	embedded.Lock()
+	a, ok := embedded.assets[name]
+	if !ok {
+		a = new(asset)
+		embedded.assets[name] = a
+	}
+	embedded.Unlock()
+
+	a.once.Do(func() {
+		if assets == nil {
+			a.err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+			return
+		}
+
+		a.payload, a.err = assets(name)
+
+		sum := sha256.Sum256(a.payload)
+		a.digest = hex.EncodeToString(sum[:])
+	})
+
+	return a, a.err
+}
+
+func embeddedName(name string) (string, bool) {
+	if strings.HasPrefix(name, EmbeddedScheme) {
+		return strings.TrimPrefix(name, EmbeddedScheme), true
+	}
+
+	return name, name != "" && filepath.Base(name) == name
+}
@@ -0,0 +1,115 @@
+package lookup_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/mdouchement/geoblock/lookup/ip2locationbin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedded(t *testing.T) {
+	dir := t.TempDir()
+
+	build := func(country string) []byte {
+		w, err := ip2locationbin.NewWriter(ip2locationbin.DB1, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Add(ip2locationbin.Range{From: netip.MustParseAddr("1.1.1.0"), To: netip.MustParseAddr("1.1.1.255"), Country: country}))
+
+		var b bytes.Buffer
+		_, err = w.WriteTo(&b)
+		assert.NoError(t, err)
+		return b.Bytes()
+	}
+
+	bin := build("US")
+
+	filename := filepath.Join(dir, "countries.BIN")
+	assert.NoError(t, os.WriteFile(filename, bin, 0o600))
+	var compact bytes.Buffer
+	assert.NoError(t, lookup.Convert(&compact, filename))
+
+	calls := make(map[string]int)
+	restore := lookup.SetAssets(func(name string) ([]byte, error) {
+		calls[name]++
+
+		switch name {
+		case "IP2LOCATION-TEST-DB1.BIN":
+			return bin, nil
+		case "IP2LOCATION-TEST-DB1.gbdb":
+			return compact.Bytes(), nil
+		default:
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+	})
+	defer restore()
+
+	// Bare filenames are embedded assets before being files.
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	assert.NoError(t, os.WriteFile("IP2LOCATION-TEST-DB1.BIN", build("FR"), 0o600))
+
+	for _, test := range []struct {
+		spec     string
+		describe string
+		country  string
+	}{
+		{
+			spec:     "embedded:IP2LOCATION-TEST-DB1.BIN",
+			describe: "ip2location DB1 embedded embedded:IP2LOCATION-TEST-DB1.BIN (2024-05-01, ipv4, 3 records)",
+			country:  "us",
+		},
+		{
+			spec:     "IP2LOCATION-TEST-DB1.BIN",
+			describe: "ip2location DB1 embedded IP2LOCATION-TEST-DB1.BIN (2024-05-01, ipv4, 3 records)",
+			country:  "us",
+		},
+		{
+			spec:     "./IP2LOCATION-TEST-DB1.BIN",
+			describe: "ip2location DB1 filesystem ./IP2LOCATION-TEST-DB1.BIN (2024-05-01, ipv4, 3 records)",
+			country:  "fr",
+		},
+		{
+			spec:     "embedded:IP2LOCATION-TEST-DB1.gbdb",
+			describe: "geoblock v1 embedded embedded:IP2LOCATION-TEST-DB1.gbdb (2024-05-01, ipv4, 3 records, in memory, from IP2Location DB1 countries.BIN)",
+			country:  "us",
+		},
+	} {
+		for _, acquire := range []bool{false, true, true} {
+			open := lookup.Open
+			if acquire {
+				open = lookup.Acquire
+			}
+
+			l, err := open(test.spec)
+			if !assert.NoError(t, err, test.spec) {
+				continue
+			}
+
+			assert.Equal(t, test.describe, lookup.Describe(l), test.spec)
+
+			record, err := l.Record(netip.MustParseAddr("1.1.1.1"))
+			assert.NoError(t, err)
+			assert.Equal(t, test.country, record.Country, test.spec)
+			assert.NoError(t, l.Close())
+		}
+	}
+
+	// The assets are decompressed once, whatever the lookups.
+	assert.Equal(t, map[string]int{"IP2LOCATION-TEST-DB1.BIN": 1, "IP2LOCATION-TEST-DB1.gbdb": 1}, calls)
+
+	_, err = lookup.Open("embedded:MISSING.BIN")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = lookup.Open("MISSING.BIN")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
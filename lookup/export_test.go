@@ -0,0 +1,19 @@
+package lookup
+
+// SetAssets replaces the embedded databases for the tests, it returns a function restoring them.
+func SetAssets(fn func(name string) ([]byte, error)) func() {
+	embedded.Lock()
+	defer embedded.Unlock()
+
+	previous := assets
+	assets = fn
+	embedded.assets = make(map[string]*asset)
+
+	return func() {
+		embedded.Lock()
+		defer embedded.Unlock()
+
+		assets = previous
+		embedded.assets = make(map[string]*asset)
+	}
+}
@@ -0,0 +1,145 @@
+package lookup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// CompileIP2locationReader reads the countries of an ip2location database in memory and returns a Lookup.
+// The reader is closed once the database is compiled.
+func CompileIP2locationReader(r Reader) (Lookup, error) {
+	return compileIP2location(r, OriginReader, "")
+}
+
+func compileIP2location(r io.ReadCloser, origin, name string) (Lookup, error) {
+	defer r.Close()
+
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("reading ip2location database: reader is not seekable")
+	}
+
+	meta, err := readIP2locationHeader(ra)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Origin = origin
+	meta.Name = name
+
+	header := make([]byte, 64)
+	if _, err = ra.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading ip2location header: %w", err)
+	}
+
+	columns := int64(header[1])
+	if columns < 2 {
+		return nil, fmt.Errorf("invalid ip2location column count: %d", columns)
+	}
+
+	t := newTable(meta)
+	countries := make(map[uint32]string)
+
+	//
+
+	v4, err := readIP2locationSection(ra, countries, header[5:], columns*4, 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading ip2location ipv4 ranges: %w", err)
+	}
+
+	for _, row := range v4 {
+		if err = t.start(netip.AddrFrom4(row.from4()), row.country); err != nil {
+			return nil, err
+		}
+	}
+
+	v6, err := readIP2locationSection(ra, countries, header[13:], 16+(columns-1)*4, 16)
+	if err != nil {
+		return nil, fmt.Errorf("reading ip2location ipv6 ranges: %w", err)
+	}
+
+	for _, row := range v6 {
+		if err = t.start(netip.AddrFrom16(row.from16()), row.country); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.build(), nil
+}
+
+// An i2lrow is the start address and the country index of an ip2location range.
+type i2lrow struct {
+	from    []byte // Little endian.
+	country string
+}
+
+func (r i2lrow) from4() [4]byte {
+	return [4]byte{r.from[3], r.from[2], r.from[1], r.from[0]}
+}
+
+func (r i2lrow) from16() [16]byte {
+	var b [16]byte
+	for i := range b {
+		b[i] = r.from[15-i]
+	}
+
+	return b
+}
+
+// readIP2locationSection reads the ranges of the section described by the given header part (row count and base address).
+func readIP2locationSection(r io.ReaderAt, countries map[uint32]string, header []byte, size int64, width int) ([]i2lrow, error) {
+	count := int64(binary.LittleEndian.Uint32(header))
+	base := int64(binary.LittleEndian.Uint32(header[4:]))
+	if count == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, count*size)
+	if _, err := r.ReadAt(data, base-1); err != nil {
+		return nil, err
+	}
+
+	rows := make([]i2lrow, count)
+	for i := range rows {
+		b := data[int64(i)*size:]
+		ptr := binary.LittleEndian.Uint32(b[width:])
+
+		country, ok := countries[ptr]
+		if !ok {
+			var err error
+			if country, err = readIP2locationString(r, ptr); err != nil {
+				return nil, err
+			}
+
+			countries[ptr] = country
+		}
+
+		rows[i] = i2lrow{from: b[:width], country: country}
+	}
+
+	return rows, nil
+}
+
+// readIP2locationString reads the string stored at the given offset, prefixed by its length.
+func readIP2locationString(r io.ReaderAt, ptr uint32) (string, error) {
+	data := make([]byte, 256)
+	n, err := r.ReadAt(data, int64(ptr))
+	if n == 0 {
+		return "", err
+	}
+
+	length := int(data[0])
+	if length >= n {
+		return "", fmt.Errorf("invalid string at offset %d", ptr)
+	}
+
+	country := strings.ToLower(string(data[1 : 1+length]))
+	if country == "-" {
+		country = PrivateAddress
+	}
+
+	return country, nil
+}
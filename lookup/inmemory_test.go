@@ -0,0 +1,172 @@
+package lookup_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/mdouchement/geoblock/lookup/ip2locationbin"
+	"github.com/stretchr/testify/assert"
+)
+
+var benchIPs = []string{
+	"1.1.1.1",
+	"80.67.169.12",
+	"127.0.0.1",
+	"::ffff:80.67.169.12",
+	"2001:910:800::12",
+	"2606:4700:4700::1111",
+	"2002:5043:a90c::1",                    // 6to4 80.67.169.12
+	"2001:0:4136:e378:8000:63bf:afbc:56f3", // Teredo 80.67.169.12
+	"::1",
+	"100.12.34.56",
+	"100.12.34.200",
+}
+
+func open(tb testing.TB, inmemory bool) lookup.Lookup {
+	spec := database(tb)
+	if inmemory {
+		spec += "?inmemory=true"
+	}
+
+	l, err := lookup.Open(spec)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		l.Close()
+	})
+
+	return l
+}
+
+// database writes an IPv6 DB1 database with 50k ranges and returns its filename.
+func database(tb testing.TB) string {
+	w, err := ip2locationbin.NewWriter(ip2locationbin.DB1, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	add := func(from, to netip.Addr, country string) {
+		if err := w.Add(ip2locationbin.Range{From: from, To: to, Country: country}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	add(netip.MustParseAddr("1.1.1.0"), netip.MustParseAddr("1.1.1.255"), "US")
+	add(netip.MustParseAddr("80.67.169.0"), netip.MustParseAddr("80.67.169.255"), "FR")
+	add(netip.MustParseAddr("2001:910::"), netip.MustParseAddr("2001:910:ffff:ffff:ffff:ffff:ffff:ffff"), "FR")
+	add(netip.MustParseAddr("2606:4700::"), netip.MustParseAddr("2606:4700:ffff:ffff:ffff:ffff:ffff:ffff"), "US")
+
+	countries := []string{"DE", "JP", "BR", "IN", "NG"}
+	for i := 0; i < 50000; i++ {
+		from := netip.AddrFrom4([4]byte{100, byte(i >> 8), byte(i), 0})
+		add(from, netip.AddrFrom4([4]byte{100, byte(i >> 8), byte(i), 127}), countries[i%len(countries)])
+	}
+
+	filename := filepath.Join(tb.TempDir(), "IP2LOCATION-LITE-DB1.IPV6.BIN")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err = w.WriteTo(f); err != nil {
+		tb.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestCompileIP2location(t *testing.T) {
+	reference := open(t, false)
+	l := open(t, true)
+
+	assert.True(t, l.Metadata().InMemory)
+	assert.Equal(t, []lookup.Field{lookup.FieldCountry}, l.Metadata().Fields)
+	assert.Contains(t, lookup.Describe(l), ", in memory)")
+
+	for _, s := range benchIPs {
+		ip := netip.MustParseAddr(s)
+
+		expected, err := reference.Record(ip)
+		assert.NoError(t, err)
+
+		record, err := l.Record(ip)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Country, record.Country, s)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = l.Record(netip.MustParseAddr("2001:910:800::12"))
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestCompileIP2location_IPv4(t *testing.T) {
+	w, err := ip2locationbin.NewWriter(ip2locationbin.DB1, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add(ip2locationbin.Range{
+		From:    netip.MustParseAddr("80.67.169.0"),
+		To:      netip.MustParseAddr("80.67.169.255"),
+		Country: "FR",
+	}))
+
+	filename := filepath.Join(t.TempDir(), "IP2LOCATION-LITE-DB1.BIN")
+	f, err := os.Create(filename)
+	assert.NoError(t, err)
+	_, err = w.WriteTo(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// IPv6 addresses are missing in IPv4 databases, compiled or not.
+	for _, spec := range []string{filename, filename + "?inmemory=true"} {
+		l, err := lookup.Open(spec)
+		assert.NoError(t, err)
+
+		for ip, expected := range map[string]string{
+			"80.67.169.12":                         "fr",
+			"::ffff:80.67.169.12":                  "fr",
+			"2002:5043:a90c::1":                    "", // 6to4
+			"2001:0:4136:e378:8000:63bf:afbc:56f3": "", // Teredo
+		} {
+			record, err := l.Record(netip.MustParseAddr(ip))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, record.Country, spec+": "+ip)
+		}
+
+		assert.NoError(t, l.Close())
+	}
+}
+
+func BenchmarkIP2location(b *testing.B) {
+	ips := make([]netip.Addr, len(benchIPs))
+	for i, s := range benchIPs {
+		ips[i] = netip.MustParseAddr(s)
+	}
+
+	for _, bench := range []struct {
+		name     string
+		inmemory bool
+	}{
+		{name: "reader"},
+		{name: "inmemory", inmemory: true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			l := open(b, bench.inmemory)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Record(ips[i%len(ips)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
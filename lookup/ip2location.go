@@ -1,14 +1,36 @@
 package lookup
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"net"
+	"net/netip"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/ip2location/ip2location-go/v9"
 )
 
+// Database origins.
+const (
+	OriginEmbedded   = "embedded"
+	OriginFilesystem = "filesystem"
+	OriginArchive    = "archive"
+	OriginReader     = "reader"
+	OriginSpec       = "spec" // Inline in the spec (see SchemeStatic).
+)
+
+// Fields availability per ip2location database type (from ip2location-go position tables).
+var i2lfields = map[Field][27]bool{
+	FieldCountry: {false, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true},
+	FieldRegion:  {false, false, false, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true},
+	FieldCity:    {false, false, false, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true, true},
+	FieldISP:     {false, false, true, false, true, false, true, true, true, false, true, false, true, false, true, false, true, false, true, true, true, false, true, true, true, true, true},
+	FieldASN:     {false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, false, true},
+}
+
 // A Reader is used to load databases.
 type Reader struct {
 	io.ReadCloser
@@ -16,41 +38,142 @@ type Reader struct {
 }
 
 type i2l struct {
-	db *ip2location.DB
+	db   *ip2location.DB
+	meta Metadata
 }
 
 // OpenIP2location opens an ip2location database and returns a Lookup.
 func OpenIP2location(dbname string) (Lookup, error) {
-	db, err := ip2location.OpenDB(dbname)
+	f, err := os.Open(dbname)
+	if err != nil {
+		return nil, err
+	}
 
-	return &i2l{
-		db: db,
-	}, err
+	return openIP2location(f, OriginFilesystem, dbname, false)
 }
 
 // OpenIP2locationReader reads an ip2location database and returns a Lookup.
 func OpenIP2locationReader(r Reader) (Lookup, error) {
+	return openIP2location(r, OriginReader, "", false)
+}
+
+func openIP2location(r ip2location.DBReader, origin, name string, inmemory bool) (Lookup, error) {
+	if inmemory {
+		return compileIP2location(r, origin, name)
+	}
+
+	meta, err := readIP2locationHeader(r)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+
+	meta.Origin = origin
+	meta.Name = name
+
 	db, err := ip2location.OpenDBWithReader(r)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
 
 	return &i2l{
-		db: db,
-	}, err
+		db:   db,
+		meta: meta,
+	}, nil
 }
 
-func (l *i2l) Country(ip net.IP) (string, error) {
-	record, err := l.db.Get_country_short(ip.String())
+func (l *i2l) Record(ip netip.Addr) (Record, error) {
+	if !ip.Unmap().Is4() && len(l.meta.Families) == 1 {
+		return Record{}, nil // IPv6 address missing in IPv4 database.
+	}
+
+	query := l.db.Get_country_short
+	if len(l.meta.Fields) > 1 {
+		query = l.db.Get_all
+	}
+
+	record, err := query(ip.String())
 	if err != nil {
-		return "", err
+		return Record{}, err
 	}
 
 	country := strings.ToLower(record.Country_short)
 	if strings.HasPrefix(country, "invalid") {
-		return "", errors.New(country)
+		return Record{}, errors.New(country)
 	}
 
 	if country == "-" {
-		return PrivateAddress, nil
+		country = PrivateAddress
+	}
+
+	r := Record{
+		Country: country,
+	}
+	if l.meta.Has(FieldRegion) {
+		r.Region = i2lvalue(record.Region)
+	}
+	if l.meta.Has(FieldCity) {
+		r.City = i2lvalue(record.City)
+	}
+	if l.meta.Has(FieldISP) {
+		r.ISP = i2lvalue(record.Isp)
+	}
+	if l.meta.Has(FieldASN) {
+		r.ASN = i2lvalue(record.Asn)
+	}
+
+	return r, nil
+}
+
+func (l *i2l) Metadata() Metadata {
+	return l.meta
+}
+
+func (l *i2l) Close() error {
+	l.db.Close()
+	return nil
+}
+
+// readIP2locationHeader reads the metadata stored in the 64-byte header of an ip2location BIN file.
+func readIP2locationHeader(r io.ReaderAt) (Metadata, error) {
+	header := make([]byte, 64)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return Metadata{}, fmt.Errorf("reading ip2location header: %w", err)
+	}
+
+	dbtype := int(header[0])
+	if dbtype == 0 || dbtype > 26 {
+		return Metadata{}, fmt.Errorf("invalid ip2location database type: %d", dbtype)
+	}
+
+	meta := Metadata{
+		Vendor:    "IP2Location",
+		Edition:   fmt.Sprintf("DB%d", dbtype),
+		BuildDate: time.Date(2000+int(header[2]), time.Month(header[3]), int(header[4]), 0, 0, 0, 0, time.UTC),
+		Families:  []string{FamilyIPv4},
+		Records:   int(binary.LittleEndian.Uint32(header[5:])),
+	}
+
+	if ipv6 := int(binary.LittleEndian.Uint32(header[13:])); ipv6 > 0 {
+		meta.Families = append(meta.Families, FamilyIPv6)
+		meta.Records += ipv6
+	}
+
+	for _, field := range []Field{FieldCountry, FieldRegion, FieldCity, FieldISP, FieldASN} {
+		if i2lfields[field][dbtype] {
+			meta.Fields = append(meta.Fields, field)
+		}
+	}
+
+	return meta, nil
+}
+
+// i2lvalue normalizes the unknown values of ip2location fields.
+func i2lvalue(v string) string {
+	if v == "-" {
+		return ""
 	}
 
-	return country, nil
+	return v
 }
@@ -0,0 +1,418 @@
+// Package ip2locationbin writes IP2Location BIN databases, e.g. to build test databases
+// or databases with local corrections.
+package ip2locationbin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+)
+
+// Supported database types.
+const (
+	DB1 = 1 // Country
+	DB2 = 2 // Country and ISP
+	DB3 = 3 // Country, region and city
+	DB4 = 4 // Country, region, city and ISP
+)
+
+// Unknown is the value of unknown fields.
+const Unknown = "-"
+
+// Fields of the supported database types, in column order.
+var columns = map[int][]lookup.Field{
+	DB1: {lookup.FieldCountry},
+	DB2: {lookup.FieldCountry, lookup.FieldISP},
+	DB3: {lookup.FieldCountry, lookup.FieldRegion, lookup.FieldCity},
+	DB4: {lookup.FieldCountry, lookup.FieldRegion, lookup.FieldCity, lookup.FieldISP},
+}
+
+// Index size per address family: ranges are indexed by the first 16 bits of the addresses.
+const indexSize = 1 << 16 * 8
+
+// A Range is an IP range of a database.
+type Range struct {
+	From        netip.Addr
+	To          netip.Addr
+	Country     string // ISO 3166 country code or Unknown.
+	CountryName string
+	Region      string
+	City        string
+	ISP         string
+}
+
+// A Writer builds an IP2Location BIN database.
+type Writer struct {
+	Type int
+	Date time.Time
+	IPv6 bool // Write an IPv6 database, set when an IPv6 range is added.
+
+	ranges [2][]Range // Per address family.
+}
+
+// NewWriter returns a new Writer for the given database type.
+func NewWriter(dbtype int, date time.Time) (*Writer, error) {
+	if _, ok := columns[dbtype]; !ok {
+		return nil, fmt.Errorf("unsupported database type: DB%d", dbtype)
+	}
+
+	return &Writer{
+		Type: dbtype,
+		Date: date,
+	}, nil
+}
+
+// Add adds the given range to the database.
+func (w *Writer) Add(r Range) error {
+	if r.From.Is4In6() && r.To.Is4In6() {
+		r.From, r.To = r.From.Unmap(), r.To.Unmap()
+	}
+
+	if !r.From.IsValid() || r.From.BitLen() != r.To.BitLen() || r.To.Less(r.From) {
+		return fmt.Errorf("invalid range %s-%s", r.From, r.To)
+	}
+
+	family := 0
+	if r.From.Is6() {
+		family = 1
+		w.IPv6 = true
+	}
+
+	w.ranges[family] = append(w.ranges[family], r)
+	return nil
+}
+
+// AddCSV adds the ranges of an IP2Location CSV database of the writer type:
+//
+//	ip_from,ip_to,country_code,country_name[,region_name,city_name][,isp]
+//
+// Addresses are decimal or textual, a header line is allowed.
+func (w *Writer) AddCSV(r io.Reader) error {
+	fields := columns[w.Type]
+
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+
+	// The family of decimal ranges is known once all the ranges are read.
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	family := lookup.CSVFamily(records)
+	if w.IPv6 {
+		family = lookup.FamilyIPv6
+	}
+
+	for i, record := range records {
+		line := i + 1
+
+		if len(record) < len(fields)+3 {
+			return fmt.Errorf("line %d: expected %d columns, got %d", line, len(fields)+3, len(record))
+		}
+
+		from, to, err := lookup.ParseRange(record[0], record[1], family)
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		rg := Range{
+			From:        from,
+			To:          to,
+			Country:     record[2],
+			CountryName: record[3],
+		}
+		for i, field := range fields[1:] {
+			rg.set(field, record[4+i])
+		}
+
+		if err = w.Add(rg); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	return nil
+}
+
+// WriteTo writes the database.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	fields := columns[w.Type]
+	families := 1
+	if w.IPv6 {
+		families = 2
+	}
+
+	if w.Date.Year() < 2000 || w.Date.Year() > 2255 {
+		return 0, fmt.Errorf("invalid date: %s", w.Date.Format("2006-01-02"))
+	}
+
+	var rows [2][]Range
+	for family := 0; family < families; family++ {
+		var err error
+		if rows[family], err = fill(w.ranges[family], family); err != nil {
+			return 0, err
+		}
+	}
+
+	// Layout: header, indexes, rows and strings.
+	var index, base [2]int
+
+	offset := 64
+	for family := 0; family < families; family++ {
+		index[family] = offset
+		offset += indexSize
+	}
+	for family := 0; family < families; family++ {
+		base[family] = offset
+		offset += (len(rows[family]) + 1) * rowSize(family, len(fields))
+	}
+
+	strs := &stringTable{
+		offset:   offset,
+		pointers: make(map[string]uint32),
+	}
+
+	var indexes, data bytes.Buffer
+	for family := 0; family < families; family++ {
+		if err := section(&indexes, &data, rows[family], family, fields, strs); err != nil {
+			return 0, err
+		}
+	}
+
+	//
+
+	size := int64(offset + strs.buf.Len())
+	if size > math.MaxUint32 {
+		return 0, errors.New("database too large")
+	}
+
+	header := make([]byte, 64)
+	header[0] = byte(w.Type)
+	header[1] = byte(len(fields) + 1)
+	header[2] = byte(w.Date.Year() - 2000)
+	header[3] = byte(w.Date.Month())
+	header[4] = byte(w.Date.Day())
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(rows[0])))
+	binary.LittleEndian.PutUint32(header[9:], uint32(base[0]+1))
+	binary.LittleEndian.PutUint32(header[21:], uint32(index[0]+1))
+	if w.IPv6 {
+		binary.LittleEndian.PutUint32(header[13:], uint32(len(rows[1])))
+		binary.LittleEndian.PutUint32(header[17:], uint32(base[1]+1))
+		binary.LittleEndian.PutUint32(header[25:], uint32(index[1]+1))
+	}
+	header[29] = 1 // Product code: IP2Location
+	header[30] = 1 // Product type: BIN
+	binary.LittleEndian.PutUint32(header[31:], uint32(size))
+
+	var n int64
+	for _, b := range [][]byte{header, indexes.Bytes(), data.Bytes(), strs.buf.Bytes()} {
+		m, err := out.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// section writes the index and the rows of an address family.
+// Each index entry holds the first and the last row of the ranges sharing the same first 16 bits.
+func section(indexes, data *bytes.Buffer, rows []Range, family int, fields []lookup.Field, strs *stringTable) error {
+	index := make([]byte, indexSize)
+	seen := make([]bool, indexSize/8)
+
+	for i, r := range rows {
+		data.Write(appendAddr(nil, r.From))
+		for _, field := range fields {
+			ptr, err := strs.pointer(field, r)
+			if err != nil {
+				return fmt.Errorf("%s-%s: %w", r.From, r.To, err)
+			}
+
+			data.Write(binary.LittleEndian.AppendUint32(nil, ptr))
+		}
+
+		for b := bucket(r.From); b <= bucket(r.To); b++ {
+			if !seen[b] {
+				seen[b] = true
+				binary.LittleEndian.PutUint32(index[b*8:], uint32(i))
+			}
+			binary.LittleEndian.PutUint32(index[b*8+4:], uint32(i))
+		}
+	}
+
+	// The last row only holds the end of the address space.
+	data.Write(appendAddr(nil, maxAddr(family)))
+	data.Write(make([]byte, len(fields)*4))
+
+	indexes.Write(index)
+	return nil
+}
+
+// fill sorts the ranges of an address family and fills the gaps with unknown ranges.
+func fill(ranges []Range, family int) ([]Range, error) {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].From.Less(sorted[j].From)
+	})
+
+	var rows []Range
+	next := netip.IPv4Unspecified()
+	if family == 1 {
+		next = netip.IPv6Unspecified()
+	}
+
+	for i, r := range sorted {
+		if !next.IsValid() || r.From.Less(next) {
+			prev := sorted[i-1]
+			return nil, fmt.Errorf("range %s-%s overlaps %s-%s", r.From, r.To, prev.From, prev.To)
+		}
+
+		if next.Less(r.From) {
+			rows = append(rows, unknown(next, r.From.Prev()))
+		}
+
+		rows = append(rows, r)
+		next = r.To.Next()
+	}
+
+	if next.IsValid() {
+		rows = append(rows, unknown(next, maxAddr(family)))
+	}
+
+	return rows, nil
+}
+
+func unknown(from, to netip.Addr) Range {
+	return Range{
+		From:        from,
+		To:          to,
+		Country:     Unknown,
+		CountryName: Unknown,
+	}
+}
+
+func (r *Range) set(field lookup.Field, v string) {
+	switch field {
+	case lookup.FieldRegion:
+		r.Region = v
+	case lookup.FieldCity:
+		r.City = v
+	case lookup.FieldISP:
+		r.ISP = v
+	}
+}
+
+func (r Range) get(field lookup.Field) string {
+	switch field {
+	case lookup.FieldCountry:
+		return r.Country
+	case lookup.FieldRegion:
+		return r.Region
+	case lookup.FieldCity:
+		return r.City
+	case lookup.FieldISP:
+		return r.ISP
+	}
+
+	return ""
+}
+
+// A stringTable holds the deduplicated strings of a database.
+type stringTable struct {
+	offset   int // Offset of the table in the database.
+	buf      bytes.Buffer
+	pointers map[string]uint32
+}
+
+// pointer returns the offset of the given field value.
+// Countries are stored as the short name, padded to 2 bytes, followed by the long name.
+func (t *stringTable) pointer(field lookup.Field, r Range) (uint32, error) {
+	values := []string{value(r.get(field))}
+	if field == lookup.FieldCountry {
+		values[0] = strings.ToUpper(values[0])
+		values = append(values, value(r.CountryName))
+
+		if len(values[0]) > 2 {
+			return 0, fmt.Errorf("invalid country code: %q", values[0])
+		}
+	}
+
+	key := string(field) + "\x00" + strings.Join(values, "\x00")
+	if ptr, ok := t.pointers[key]; ok {
+		return ptr, nil
+	}
+
+	ptr := uint32(t.offset + t.buf.Len())
+	for i, v := range values {
+		if len(v) > 255 {
+			return 0, fmt.Errorf("%s too long: %q", field, v)
+		}
+
+		t.buf.WriteByte(byte(len(v)))
+		t.buf.WriteString(v)
+		if field == lookup.FieldCountry && i == 0 {
+			t.buf.Write(make([]byte, 2-len(v)))
+		}
+	}
+
+	t.pointers[key] = ptr
+	return ptr, nil
+}
+
+func value(v string) string {
+	if v == "" {
+		return Unknown
+	}
+
+	return v
+}
+
+func rowSize(family, fields int) int {
+	if family == 1 {
+		return 16 + fields*4
+	}
+
+	return 4 + fields*4
+}
+
+// appendAddr appends the little endian representation of the given address.
+func appendAddr(b []byte, addr netip.Addr) []byte {
+	v := addr.AsSlice()
+	for i := len(v) - 1; i >= 0; i-- {
+		b = append(b, v[i])
+	}
+
+	return b
+}
+
+// bucket returns the index bucket of the given address.
+func bucket(addr netip.Addr) int {
+	v := addr.AsSlice()
+	return int(v[0])<<8 | int(v[1])
+}
+
+func maxAddr(family int) netip.Addr {
+	if family == 1 {
+		return netip.AddrFrom16([16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+
+	return netip.AddrFrom4([4]byte{0xff, 0xff, 0xff, 0xff})
+}
@@ -0,0 +1,142 @@
+package ip2locationbin_test
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/mdouchement/geoblock/lookup/ip2locationbin"
+	"github.com/stretchr/testify/assert"
+)
+
+var date = time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+
+func TestWriter(t *testing.T) {
+	w, err := ip2locationbin.NewWriter(ip2locationbin.DB1, date)
+	assert.NoError(t, err)
+
+	for _, r := range []struct {
+		from, to string
+		country  string
+	}{
+		{from: "80.67.169.0", to: "80.67.169.255", country: "FR"},
+		{from: "1.1.1.0", to: "1.1.1.255", country: "US"},
+		{from: "1.2.0.0", to: "1.5.255.255", country: "CN"},
+		{from: "2001:910::", to: "2001:910:ffff:ffff:ffff:ffff:ffff:ffff", country: "FR"},
+		{from: "2606:4700::", to: "2606:4700:ffff:ffff:ffff:ffff:ffff:ffff", country: "US"},
+	} {
+		err = w.Add(ip2locationbin.Range{
+			From:    netip.MustParseAddr(r.from),
+			To:      netip.MustParseAddr(r.to),
+			Country: r.country,
+		})
+		assert.NoError(t, err)
+	}
+
+	l := write(t, w, "DB1.IPV6.BIN")
+	meta := l.Metadata()
+	assert.Equal(t, "DB1", meta.Edition)
+	assert.Equal(t, date, meta.BuildDate)
+	assert.Equal(t, []string{lookup.FamilyIPv4, lookup.FamilyIPv6}, meta.Families)
+
+	expect(t, l, map[string]lookup.Record{
+		"0.0.0.1":              {Country: lookup.PrivateAddress},
+		"1.1.1.1":              {Country: "us"},
+		"1.1.2.1":              {Country: lookup.PrivateAddress},
+		"1.3.0.1":              {Country: "cn"},
+		"1.5.255.255":          {Country: "cn"},
+		"80.67.169.12":         {Country: "fr"},
+		"255.255.255.255":      {Country: lookup.PrivateAddress},
+		"::ffff:1.1.1.1":       {Country: "us"},
+		"2001:910:800::12":     {Country: "fr"},
+		"2001:911::12":         {Country: lookup.PrivateAddress},
+		"2606:4700:4700::1111": {Country: "us"},
+	})
+
+	err = w.Add(ip2locationbin.Range{
+		From:    netip.MustParseAddr("1.1.1.128"),
+		To:      netip.MustParseAddr("1.1.2.255"),
+		Country: "AU",
+	})
+	assert.NoError(t, err)
+
+	_, err = w.WriteTo(new(bytes.Buffer))
+	assert.EqualError(t, err, "range 1.1.1.128-1.1.2.255 overlaps 1.1.1.0-1.1.1.255")
+
+	_, err = ip2locationbin.NewWriter(5, date)
+	assert.EqualError(t, err, "unsupported database type: DB5")
+}
+
+func TestWriter_AddCSV(t *testing.T) {
+	w, err := ip2locationbin.NewWriter(ip2locationbin.DB3, date)
+	assert.NoError(t, err)
+
+	err = w.AddCSV(strings.NewReader(`ip_from,ip_to,country_code,country_name,region_name,city_name
+"0","281470681743359","-","-","-","-"
+"281470698586368","281470698586623","US","United States of America","California","Los Angeles"
+"281472028354816","281472028355071","FR","France","Ile-de-France","Paris"
+"42540671971312875853813573447265026048","42540672050541038368077911040808976383","FR","France","Ile-de-France","Paris"
+`))
+	assert.NoError(t, err)
+
+	l := write(t, w, "DB3.IPV6.BIN")
+	assert.Equal(t, []lookup.Field{lookup.FieldCountry, lookup.FieldRegion, lookup.FieldCity}, l.Metadata().Fields)
+
+	expect(t, l, map[string]lookup.Record{
+		"1.1.1.1":          {Country: "us", Region: "California", City: "Los Angeles"},
+		"80.67.169.12":     {Country: "fr", Region: "Ile-de-France", City: "Paris"},
+		"2001:910:800::12": {Country: "fr", Region: "Ile-de-France", City: "Paris"},
+		"::1":              {Country: lookup.PrivateAddress},
+	})
+
+	err = w.AddCSV(strings.NewReader(`"1","2","US","United States of America"`))
+	assert.EqualError(t, err, "line 1: expected 6 columns, got 4")
+}
+
+// write writes the database and reads it back.
+func write(t *testing.T, w *ip2locationbin.Writer, name string) lookup.Lookup {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), name)
+
+	f, err := os.Create(filename)
+	assert.NoError(t, err)
+
+	_, err = w.WriteTo(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	l, err := lookup.OpenIP2location(filename)
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	return l
+}
+
+// expect checks the records of the database, the countries are also checked in memory.
+func expect(t *testing.T, l lookup.Lookup, records map[string]lookup.Record) {
+	t.Helper()
+
+	compiled, err := lookup.Open(l.Metadata().Name + "?inmemory=true")
+	assert.NoError(t, err)
+	defer compiled.Close()
+
+	for ip, expected := range records {
+		record, err := l.Record(netip.MustParseAddr(ip))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, expected, record, ip)
+
+		record, err = compiled.Record(netip.MustParseAddr(ip))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, expected.Country, record.Country, ip)
+	}
+}
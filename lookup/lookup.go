@@ -1,11 +1,274 @@
 package lookup
 
-import "net"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"strings"
+	"time"
+)
 
 // PrivateAddress is the country value for private network.
 const PrivateAddress = "-"
 
-// A Lookup is able to compute metadata about an IP.
-type Lookup interface {
-	Country(ip net.IP) (string, error)
+// Address families.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Supported fields.
+const (
+	FieldCountry Field = "country"
+	FieldRegion  Field = "region"
+	FieldCity    Field = "city"
+	FieldISP     Field = "isp"
+	FieldASN     Field = "asn"
+)
+
+type (
+	// A Lookup is able to compute metadata about an IP.
+	// Closing a Lookup releases its underlying database.
+	Lookup interface {
+		io.Closer
+		// Record returns the known fields of the given IP, an empty record means the IP is not found.
+		Record(ip netip.Addr) (Record, error)
+		Metadata() Metadata
+	}
+
+	// A Record holds the fields of an IP.
+	Record struct {
+		Country string // Lowercased ISO 3166 country code or PrivateAddress.
+		Region  string
+		City    string
+		ISP     string
+		ASN     string
+	}
+
+	// A Field is an information a Lookup is able to answer.
+	Field string
+
+	// A Metadata describes the database of a Lookup.
+	Metadata struct {
+		Vendor    string    // e.g. IP2Location
+		Edition   string    // e.g. DB1
+		BuildDate time.Time // Zero when unknown.
+		Families  []string  // Address families covered by the database.
+		Records   int       // Number of ranges.
+		Fields    []Field   // Available fields.
+		Origin    string    // Where the database has been loaded from.
+		Name      string    // Database name, empty for readers.
+		InMemory  bool      // Compiled in memory.
+		Source    string    // Source database of converted databases.
+	}
+)
+
+// Open resolves the given database spec, verifies it and returns a Lookup.
+// Specs prefixed by a registered scheme (see Register) are opened by their backend.
+// Otherwise, embedded assets are tried before the filesystem for bare filenames.
+// Archives are decompressed in memory, .csv databases are loaded with OpenCSV and
+// delegated-* files with OpenRIR and compact databases (see Convert) are detected by their magic.
+// Options are described in Spec.
+func Open(s string) (Lookup, error) {
+	spec, err := ParseSpec(s)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, _, err = spec.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := open(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return spec.restrict(l), nil
+}
+
+// open opens the database of the given spec, the verified file is released once opened.
+func open(spec Spec) (Lookup, error) {
+	defer spec.release()
+
+	open := resolve
+	if backend, ok := lookupBackend(spec.Scheme); ok {
+		open = backend.open
+	}
+
+	l, err := open(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = spec.VerifyType(l.Metadata()); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func resolve(spec Spec) (Lookup, error) {
+	payload, err := Embedded(spec.Name)
+	if err == nil && isCompact(payload) {
+		return openCompact(payload, OriginEmbedded, spec.Name)
+	}
+	if err == nil {
+		return openIP2location(memory{bytes.NewReader(payload)}, OriginEmbedded, spec.Name, spec.InMemory())
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if IsArchive(spec.Name) {
+		payload, entry, err := spec.extract()
+		if err != nil {
+			return nil, err
+		}
+
+		if isCompact(payload) {
+			return openCompact(payload, OriginArchive, spec.Name+"#"+entry)
+		}
+
+		if isCSV(entry) {
+			return openCSV(bytes.NewReader(payload), OriginArchive, spec.Name+"#"+entry)
+		}
+
+		return openIP2location(memory{bytes.NewReader(payload)}, OriginArchive, spec.Name+"#"+entry, spec.InMemory())
+	}
+
+	if isCSV(spec.Name) {
+		return openCSVSpec(spec)
+	}
+
+	if IsRIR(spec.Name) {
+		return openRIR(spec, spec.Name)
+	}
+
+	f, err := spec.openFile(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(CompactMagic))
+	if _, err = f.ReadAt(magic, 0); err == nil && isCompact(magic) {
+		payload, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return openCompact(payload, OriginFilesystem, spec.Name)
+	}
+
+	return openIP2location(f, OriginFilesystem, spec.Name, spec.InMemory())
+}
+
+// Describe returns a human readable provenance of the given lookup.
+func Describe(l Lookup) string {
+	m := l.Metadata()
+
+	var b strings.Builder
+	b.WriteString(strings.ToLower(m.Vendor))
+	if m.Edition != "" {
+		b.WriteString(" " + m.Edition)
+	}
+	b.WriteString(" " + m.Origin)
+	if m.Name != "" {
+		b.WriteString(" " + m.Name)
+	}
+
+	date := "unknown date"
+	if !m.BuildDate.IsZero() {
+		date = m.BuildDate.Format("2006-01-02")
+	}
+	fmt.Fprintf(&b, " (%s, %s, %d records", date, strings.Join(m.Families, "+"), m.Records)
+	if m.InMemory {
+		b.WriteString(", in memory")
+	}
+	if m.Source != "" {
+		b.WriteString(", from " + m.Source)
+	}
+	b.WriteString(")")
+
+	return b.String()
+}
+
+// Get returns the value of the given field.
+func (r Record) Get(field Field) string {
+	switch field {
+	case FieldCountry:
+		return r.Country
+	case FieldRegion:
+		return r.Region
+	case FieldCity:
+		return r.City
+	case FieldISP:
+		return r.ISP
+	case FieldASN:
+		return r.ASN
+	}
+
+	return ""
+}
+
+// Merge fills the unknown fields of the record with the ones of the given record.
+func (r *Record) Merge(o Record) {
+	if r.Country == "" {
+		r.Country = o.Country
+	}
+	if r.Region == "" {
+		r.Region = o.Region
+	}
+	if r.City == "" {
+		r.City = o.City
+	}
+	if r.ISP == "" {
+		r.ISP = o.ISP
+	}
+	if r.ASN == "" {
+		r.ASN = o.ASN
+	}
+}
+
+func (r *Record) set(field Field, v string) {
+	switch field {
+	case FieldCountry:
+		r.Country = v
+	case FieldRegion:
+		r.Region = v
+	case FieldCity:
+		r.City = v
+	case FieldISP:
+		r.ISP = v
+	case FieldASN:
+		r.ASN = v
+	}
+}
+
+// isField returns true if the given field is supported.
+func isField(field Field) bool {
+	switch field {
+	case FieldCountry, FieldRegion, FieldCity, FieldISP, FieldASN:
+		return true
+	}
+
+	return false
+}
+
+// Has returns true if the metadata lists the given field.
+func (m Metadata) Has(field Field) bool {
+	for _, f := range m.Fields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,498 @@
+package lookup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VendorMaxMind is the vendor of MaxMind DB databases.
+const VendorMaxMind = "MaxMind"
+
+// mmdbMarker starts the metadata section of a MaxMind DB file.
+var mmdbMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbIPv4 is the IPv4 subtree of IPv6 MaxMind DB databases.
+var mmdbIPv4 = netip.MustParsePrefix("::/96")
+
+// IPv6 ranges aliased to the IPv4 subtree in MaxMind DB databases.
+var mmdbAliases = []netip.Prefix{
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("2001::/32"),
+}
+
+// mmdbMaxDepth bounds the nesting of the decoded values, pointers included.
+const mmdbMaxDepth = 32
+
+// An mmdb is a MaxMind DB file (https://maxmind.github.io/MaxMind-DB/).
+type mmdb struct {
+	buf        []byte
+	nodes      uint
+	recordSize uint
+	ipVersion  uint
+	dbtype     string
+	builddate  time.Time
+	data       []byte // Data section.
+	ipv4       uint   // Root node of the IPv4 subtree.
+	meta       Metadata
+}
+
+// OpenMMDB opens a MaxMind DB database and returns a Lookup.
+// The database is loaded in memory.
+func OpenMMDB(name string) (Lookup, error) {
+	return openMMDBSpec(Spec{Name: name})
+}
+
+func openMMDBSpec(spec Spec) (Lookup, error) {
+	name := spec.Name
+
+	payload, err := spec.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := parseMMDB(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	db.meta = Metadata{
+		Vendor:    VendorMaxMind,
+		Edition:   db.dbtype,
+		BuildDate: db.builddate,
+		Families:  []string{FamilyIPv4},
+		Fields:    mmdbFields(db.dbtype),
+		Origin:    OriginFilesystem,
+		Name:      name,
+		InMemory:  true,
+	}
+	if db.ipVersion == 6 {
+		db.meta.Families = append(db.meta.Families, FamilyIPv6)
+	}
+
+	err = db.walk(func(netip.Prefix, uint) error {
+		db.meta.Records++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return db, nil
+}
+
+// mmdbFields returns the fields of the given database type (e.g. GeoLite2-City).
+func mmdbFields(dbtype string) []Field {
+	switch {
+	case strings.Contains(dbtype, "ASN"), strings.Contains(dbtype, "ISP"):
+		return []Field{FieldISP, FieldASN}
+	case strings.Contains(dbtype, "Enterprise"):
+		return []Field{FieldCountry, FieldRegion, FieldCity, FieldISP, FieldASN}
+	case strings.Contains(dbtype, "City"):
+		return []Field{FieldCountry, FieldRegion, FieldCity}
+	}
+
+	return []Field{FieldCountry}
+}
+
+// Record returns the known fields of the given IP.
+func (db *mmdb) Record(ip netip.Addr) (Record, error) {
+	offset, ok := db.search(ip)
+	if !ok {
+		return Record{}, nil
+	}
+
+	return db.record(offset)
+}
+
+// Metadata returns the database metadata.
+func (db *mmdb) Metadata() Metadata {
+	return db.meta
+}
+
+// Close implements the io.Closer interface.
+func (db *mmdb) Close() error {
+	return nil
+}
+
+// isMMDB returns true if the given name is a MaxMind DB database.
+func isMMDB(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".mmdb")
+}
+
+func parseMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, mmdbMarker)
+	if i < 0 {
+		return nil, errors.New("invalid mmdb: metadata not found")
+	}
+
+	db := &mmdb{buf: buf}
+
+	v, _, err := db.decode(buf[i+len(mmdbMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata: %w", err)
+	}
+
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata")
+	}
+
+	db.nodes = mmdbUint(meta["node_count"])
+	db.recordSize = mmdbUint(meta["record_size"])
+	db.ipVersion = mmdbUint(meta["ip_version"])
+	db.dbtype, _ = meta["database_type"].(string)
+	if epoch := mmdbUint(meta["build_epoch"]); epoch > 0 {
+		db.builddate = time.Unix(int64(epoch), 0).UTC()
+	}
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("invalid mmdb record size: %d", db.recordSize)
+	}
+
+	tree := db.nodes * db.recordSize / 4
+	if tree+16 > uint(i) {
+		return nil, errors.New("invalid mmdb: truncated search tree")
+	}
+	db.data = buf[tree+16 : i]
+
+	if db.ipVersion == 6 {
+		for depth := 0; depth < 96 && db.ipv4 < db.nodes; depth++ {
+			db.ipv4 = db.node(db.ipv4, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// search returns the data offset of the given IP.
+func (db *mmdb) search(ip netip.Addr) (uint, bool) {
+	ip = ip.Unmap()
+
+	n := uint(0)
+	var addr []byte
+	switch {
+	case ip.Is4():
+		n = db.ipv4
+		b := ip.As4()
+		addr = b[:]
+	case db.ipVersion == 6:
+		b := ip.As16()
+		addr = b[:]
+	default:
+		return 0, false
+	}
+
+	for depth := 0; depth < len(addr)*8 && n < db.nodes; depth++ {
+		n = db.node(n, uint(addr[depth/8]>>(7-depth%8)&1))
+	}
+
+	if n <= db.nodes {
+		return 0, false // Empty or invalid search tree.
+	}
+
+	return n - db.nodes - 16, true
+}
+
+// node returns the left (0) or right (1) record of the given node.
+func (db *mmdb) node(n uint, bit uint) uint {
+	b := db.buf[n*db.recordSize/4:]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// walk calls fn for each network of the search tree pointing to data, in address order.
+// IPv4 networks of IPv6 trees are reported as IPv4 and aliases are skipped.
+func (db *mmdb) walk(fn func(network netip.Prefix, offset uint) error) error {
+	bits := 32
+	if db.ipVersion == 6 {
+		bits = 128
+	}
+
+	var visit func(n uint, addr [16]byte, depth int) error
+	visit = func(n uint, addr [16]byte, depth int) error {
+		if n == db.nodes {
+			return nil // Empty.
+		}
+
+		if n > db.nodes {
+			return fn(db.network(addr, depth), n-db.nodes-16)
+		}
+
+		if depth >= bits {
+			return errors.New("invalid mmdb: search tree too deep")
+		}
+
+		if bits == 128 && depth > 0 {
+			for _, alias := range mmdbAliases {
+				if depth == alias.Bits() && netip.AddrFrom16(addr) == alias.Addr() {
+					return nil
+				}
+			}
+		}
+
+		for bit := uint(0); bit < 2; bit++ {
+			next := addr
+			if bit == 1 {
+				next[depth/8] |= 0x80 >> (depth % 8)
+			}
+
+			if err := visit(db.node(n, bit), next, depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return visit(0, [16]byte{}, 0)
+}
+
+// network returns the network of the given address and depth.
+func (db *mmdb) network(addr [16]byte, depth int) netip.Prefix {
+	if db.ipVersion != 6 {
+		var b [4]byte
+		copy(b[:], addr[:])
+		return netip.PrefixFrom(netip.AddrFrom4(b), depth)
+	}
+
+	ip := netip.AddrFrom16(addr)
+	if depth >= 96 && mmdbIPv4.Contains(ip) {
+		var b [4]byte
+		copy(b[:], addr[12:])
+		return netip.PrefixFrom(netip.AddrFrom4(b), depth-96)
+	}
+
+	return netip.PrefixFrom(ip, depth)
+}
+
+// country returns the lowercased country of the data record at the given offset.
+func (db *mmdb) country(offset uint) (string, error) {
+	r, err := db.record(offset)
+	return r.Country, err
+}
+
+// record returns the data record at the given offset.
+// The registered country is used when the location is unknown and English names are used for regions and cities.
+func (db *mmdb) record(offset uint) (Record, error) {
+	v, _, err := db.decode(db.data, offset, 0)
+	if err != nil {
+		return Record{}, err
+	}
+
+	var r Record
+	data, _ := v.(map[string]interface{})
+
+	for _, key := range []string{"country", "registered_country"} {
+		if code, ok := mmdbGet(data, key, "iso_code").(string); ok && code != "" {
+			r.Country = strings.ToLower(code)
+			break
+		}
+	}
+
+	if subdivisions, ok := data["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		r.Region, _ = mmdbGet(subdivisions[0], "names", "en").(string)
+	}
+	r.City, _ = mmdbGet(data, "city", "names", "en").(string)
+
+	if asn, ok := data["autonomous_system_number"].(uint64); ok {
+		r.ASN = strconv.FormatUint(asn, 10)
+	}
+	if r.ISP, _ = data["isp"].(string); r.ISP == "" {
+		r.ISP, _ = data["autonomous_system_organization"].(string)
+	}
+
+	return r, nil
+}
+
+// mmdbGet returns the value at the given path of nested maps.
+func mmdbGet(v interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		v = m[key]
+	}
+
+	return v
+}
+
+// decode decodes the value stored at the given offset of the section, nested at the given depth.
+// It returns the value and the offset of the next value.
+func (db *mmdb) decode(section []byte, offset, depth uint) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deep")
+	}
+
+	if offset >= uint(len(section)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	ctrl := section[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == 1 { // Pointer
+		size := uint(ctrl>>3) & 0x3
+		if offset+size+1 > uint(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+
+		var p uint
+		if size < 3 {
+			p = uint(ctrl & 0x7)
+		}
+		for _, b := range section[offset : offset+size+1] {
+			p = p<<8 | uint(b)
+		}
+
+		switch size {
+		case 1:
+			p += 2048
+		case 2:
+			p += 526336
+		}
+
+		v, _, err := db.decode(db.data, p, depth+1)
+		return v, offset + size + 1, err
+	}
+
+	if kind == 0 { // Extended
+		if offset >= uint(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+
+		kind = 7 + uint(section[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+
+		var v uint
+		for _, b := range section[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		offset += n
+
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	switch kind {
+	case 7: // Map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := db.decode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid map key")
+			}
+
+			var v interface{}
+			if v, offset, err = db.decode(section, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			m[key] = v
+		}
+
+		return m, offset, nil
+	case 11: // Array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			var err error
+			if v, offset, err = db.decode(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+		}
+
+		return a, offset, nil
+	case 14: // Boolean
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(section)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b := section[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // Bytes
+		return b, offset, nil
+	case 5, 6, 9: // Unsigned integers
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), offset, nil
+	case 10: // uint128
+		return b, offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type: %d", kind)
+}
+
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
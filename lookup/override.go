@@ -0,0 +1,229 @@
+package lookup
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VendorOverride is the vendor of override lookups.
+const VendorOverride = "Override"
+
+// An OverrideEntry maps a CIDR to a country and optional fields.
+type OverrideEntry struct {
+	CIDR    string `yaml:"cidr"`
+	Country string `yaml:"country"`
+	Region  string `yaml:"region"`
+	City    string `yaml:"city"`
+	ISP     string `yaml:"isp"`
+	ASN     string `yaml:"asn"`
+}
+
+// An override is a Lookup answering from local CIDR overrides with longest-prefix precedence.
+type override struct {
+	prefixes []netip.Prefix // Sorted by decreasing prefix length.
+	records  []Record
+	meta     Metadata
+}
+
+// OpenOverride opens an override file and returns a Lookup.
+// Files are either YAML lists of OverrideEntry (.yml or .yaml) or CSV files with a
+// `cidr,country[,region,city,isp,asn]` header.
+func OpenOverride(name string) (Lookup, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []OverrideEntry
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yml", ".yaml":
+		err = yaml.NewDecoder(f).Decode(&entries)
+		if errors.Is(err, io.EOF) {
+			err = nil // Empty file
+		}
+	case ".csv":
+		entries, err = readOverrideCSV(f)
+	default:
+		err = errors.New("unsupported override format, expected .yml, .yaml or .csv")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	l, err := NewOverride(entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	l.(*override).meta.Origin = OriginFilesystem
+	l.(*override).meta.Name = name
+	return l, nil
+}
+
+// NewOverride returns a Lookup answering from the given override entries.
+func NewOverride(entries []OverrideEntry) (Lookup, error) {
+	l := &override{
+		meta: Metadata{
+			Vendor:  VendorOverride,
+			Records: len(entries),
+			Origin:  OriginReader,
+		},
+	}
+
+	seen := make(map[netip.Prefix]bool)
+	fields := make(map[Field]bool)
+	var ipv4, ipv6 bool
+
+	for i, e := range entries {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(e.CIDR))
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		prefix = prefix.Masked()
+
+		if seen[prefix] {
+			return nil, fmt.Errorf("entry %d: duplicated cidr %s", i+1, prefix)
+		}
+		seen[prefix] = true
+
+		country := strings.ToLower(strings.TrimSpace(e.Country))
+		if country == "" {
+			return nil, fmt.Errorf("entry %d: %s: missing country", i+1, prefix)
+		}
+
+		r := Record{
+			Country: country,
+			Region:  e.Region,
+			City:    e.City,
+			ISP:     e.ISP,
+			ASN:     e.ASN,
+		}
+
+		for _, field := range []Field{FieldCountry, FieldRegion, FieldCity, FieldISP, FieldASN} {
+			if r.Get(field) != "" {
+				fields[field] = true
+			}
+		}
+
+		ipv4 = ipv4 || prefix.Addr().Is4()
+		ipv6 = ipv6 || prefix.Addr().Is6()
+
+		l.prefixes = append(l.prefixes, prefix)
+		l.records = append(l.records, r)
+	}
+
+	sort.Stable(l)
+
+	for _, field := range []Field{FieldCountry, FieldRegion, FieldCity, FieldISP, FieldASN} {
+		if fields[field] {
+			l.meta.Fields = append(l.meta.Fields, field)
+		}
+	}
+	if ipv4 {
+		l.meta.Families = append(l.meta.Families, FamilyIPv4)
+	}
+	if ipv6 {
+		l.meta.Families = append(l.meta.Families, FamilyIPv6)
+	}
+
+	return l, nil
+}
+
+func (l *override) Record(ip netip.Addr) (Record, error) {
+	if !ip.IsValid() {
+		return Record{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	addr := ip.Unmap()
+
+	for i, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return l.records[i], nil
+		}
+	}
+
+	return Record{}, nil
+}
+
+func (l *override) Metadata() Metadata {
+	return l.meta
+}
+
+func (l *override) Close() error {
+	return nil
+}
+
+// sort.Interface sorting by decreasing prefix length.
+func (l *override) Len() int           { return len(l.prefixes) }
+func (l *override) Less(i, j int) bool { return l.prefixes[i].Bits() > l.prefixes[j].Bits() }
+func (l *override) Swap(i, j int) {
+	l.prefixes[i], l.prefixes[j] = l.prefixes[j], l.prefixes[i]
+	l.records[i], l.records[j] = l.records[j], l.records[i]
+}
+
+func readOverrideCSV(r io.Reader) ([]OverrideEntry, error) {
+	codec := csv.NewReader(r)
+	codec.TrimLeadingSpace = true
+
+	header, err := codec.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+
+		switch column {
+		case "cidr", "country", "region", "city", "isp", "asn":
+			columns[column] = i
+		default:
+			return nil, fmt.Errorf("unknown column: %s", column)
+		}
+	}
+
+	if _, ok := columns["cidr"]; !ok {
+		return nil, errors.New("missing cidr column")
+	}
+
+	var entries []OverrideEntry
+	for {
+		record, err := codec.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return record[i]
+			}
+
+			return ""
+		}
+
+		entries = append(entries, OverrideEntry{
+			CIDR:    value("cidr"),
+			Country: value("country"),
+			Region:  value("region"),
+			City:    value("city"),
+			ISP:     value("isp"),
+			ASN:     value("asn"),
+		})
+	}
+}
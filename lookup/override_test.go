@@ -0,0 +1,73 @@
+package lookup_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenOverride(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"overrides.yml": `
+- cidr: 1.1.0.0/16
+  country: DE
+- cidr: 1.1.1.0/24
+  country: FR
+  region: Île-de-France
+  asn: "64496"
+- cidr: 2001:db8::/32
+  country: be
+`,
+		"overrides.csv": `cidr,country,region,asn
+1.1.0.0/16,DE,,
+1.1.1.0/24,FR,Île-de-France,64496
+2001:db8::/32,be,,
+`,
+	}
+
+	for filename, content := range files {
+		filename = filepath.Join(dir, filename)
+		assert.NoError(t, os.WriteFile(filename, []byte(content), 0o644))
+
+		l, err := lookup.OpenOverride(filename)
+		if !assert.NoError(t, err, filename) {
+			continue
+		}
+
+		assert.Equal(t, lookup.VendorOverride, l.Metadata().Vendor)
+		assert.Equal(t, []lookup.Field{lookup.FieldCountry, lookup.FieldRegion, lookup.FieldASN}, l.Metadata().Fields)
+
+		tests := map[string]lookup.Record{
+			"1.1.1.1":        {Country: "fr", Region: "Île-de-France", ASN: "64496"}, // Longest prefix
+			"::ffff:1.1.1.1": {Country: "fr", Region: "Île-de-France", ASN: "64496"},
+			"1.1.2.1":        {Country: "de"},
+			"1.2.0.1":        {},
+			"2001:db8::1":    {Country: "be"},
+		}
+
+		for ip, expected := range tests {
+			record, err := l.Record(netip.MustParseAddr(ip))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, record, filename+": "+ip)
+		}
+	}
+}
+
+func TestNewOverride(t *testing.T) {
+	_, err := lookup.NewOverride([]lookup.OverrideEntry{
+		{CIDR: "1.1.1.0/24", Country: "FR"},
+		{CIDR: "1.1.1.1/24", Country: "DE"},
+	})
+	assert.EqualError(t, err, "entry 2: duplicated cidr 1.1.1.0/24")
+
+	_, err = lookup.NewOverride([]lookup.OverrideEntry{
+		{CIDR: "1.1.1.0/24"},
+	})
+	assert.EqualError(t, err, "entry 1: 1.1.1.0/24: missing country")
+}
@@ -0,0 +1,110 @@
+package lookup
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// A span is an IP range associated to a country.
+type span struct {
+	from    netip.Addr
+	to      netip.Addr
+	country string
+}
+
+// A ranges is an interval index of non-overlapping IP ranges sorted by address.
+type ranges []span
+
+// newRanges validates the given spans and returns an interval index.
+// Spans are expected to be sorted by address for each address family.
+// The label function is used to report the origin of the invalid spans (e.g. line numbers).
+func newRanges(spans []span, label func(i int) string) (ranges, error) {
+	var last [2]int // Last span index per address family, shifted by one.
+
+	for i, s := range spans {
+		if s.from.BitLen() != s.to.BitLen() || s.to.Less(s.from) {
+			return nil, fmt.Errorf("%s: invalid range %s-%s", label(i), s.from, s.to)
+		}
+
+		family := 0
+		if s.from.Is6() {
+			family = 1
+		}
+
+		if j := last[family] - 1; j >= 0 {
+			prev := spans[j]
+
+			if s.from.Less(prev.from) {
+				return nil, fmt.Errorf("%s: unsorted range %s-%s after %s-%s (%s)", label(i), s.from, s.to, prev.from, prev.to, label(j))
+			}
+
+			if !prev.to.Less(s.from) {
+				return nil, fmt.Errorf("%s: range %s-%s overlaps %s-%s (%s)", label(i), s.from, s.to, prev.from, prev.to, label(j))
+			}
+		}
+
+		last[family] = i + 1
+	}
+
+	r := make(ranges, len(spans))
+	copy(r, spans)
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].from.Less(r[j].from)
+	})
+
+	return r, nil
+}
+
+// find returns the span containing the given IP.
+func (r ranges) find(ip netip.Addr) (span, bool) {
+	ip = ip.Unmap()
+
+	// Index of the first span starting after the IP.
+	i, j := 0, len(r)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if ip.Less(r[h].from) {
+			j = h
+		} else {
+			i = h + 1
+		}
+	}
+
+	if i == 0 {
+		return span{}, false
+	}
+
+	s := r[i-1]
+	if s.to.Less(ip) || s.from.BitLen() != ip.BitLen() {
+		return span{}, false
+	}
+
+	return s, true
+}
+
+// families returns the address families covered by the index.
+func (r ranges) families() []string {
+	var families []string
+
+	if len(r) > 0 && r[0].from.Is4() {
+		families = append(families, FamilyIPv4)
+	}
+	if len(r) > 0 && r[len(r)-1].from.Is6() {
+		families = append(families, FamilyIPv6)
+	}
+
+	return families
+}
+
+// lastAddr returns the last address of the given prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
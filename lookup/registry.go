@@ -0,0 +1,180 @@
+package lookup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var registry = struct {
+	sync.Mutex
+	entries  map[string]*entry
+	updaters map[string]*updaterEntry
+}{
+	entries:  make(map[string]*entry),
+	updaters: make(map[string]*updaterEntry),
+}
+
+// An entry is a database opened once and shared across the process.
+// It is registered before being opened so that concurrent acquisitions wait for it,
+// the registry is not locked while opening.
+type entry struct {
+	key    string
+	ready  chan struct{} // Closed once opened.
+	lookup Lookup
+	err    error
+	refs   int
+}
+
+// A shared is a reference to a registry entry.
+type shared struct {
+	Lookup
+	entry *entry
+	once  sync.Once
+}
+
+// Acquire returns a Lookup for the given database spec shared across the process.
+// The database content is verified against the spec options before use.
+// Identical databases, keyed by path and content hash, are opened once and released
+// when the last reference is closed. The family and fields options only apply to the returned Lookup.
+func Acquire(s string) (Lookup, error) {
+	spec, err := ParseSpec(s)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, digest, err := spec.verify()
+	if err != nil {
+		return nil, err
+	}
+	defer spec.release()
+
+	key := spec.Scheme + ":" + spec.Name + "#" + spec.Entry + "@" + digest
+	if spec.InMemory() {
+		key += "+inmemory"
+	}
+
+	registry.Lock()
+	e, ok := registry.entries[key]
+	if !ok {
+		e = &entry{
+			key:   key,
+			ready: make(chan struct{}),
+		}
+		registry.entries[key] = e
+	}
+	e.refs++
+	registry.Unlock()
+
+	if !ok {
+		e.lookup, e.err = open(spec)
+		if e.err != nil {
+			// The next acquisitions try again.
+			registry.Lock()
+			delete(registry.entries, key)
+			registry.Unlock()
+		}
+		close(e.ready)
+	}
+	<-e.ready
+
+	if e.err != nil {
+		_ = e.release()
+		return nil, e.err
+	}
+
+	if ok {
+		if err = spec.VerifyType(e.lookup.Metadata()); err != nil {
+			_ = e.release()
+			return nil, err
+		}
+	}
+
+	return spec.restrict(&shared{
+		Lookup: e.lookup,
+		entry:  e,
+	}), nil
+}
+
+// release drops a reference to the entry, the database is closed with the last one.
+func (e *entry) release() error {
+	registry.Lock()
+	e.refs--
+	last := e.refs == 0
+	if last && registry.entries[e.key] == e {
+		delete(registry.entries, e.key)
+	}
+	registry.Unlock()
+
+	if !last || e.lookup == nil {
+		return nil
+	}
+
+	return e.lookup.Close()
+}
+
+// Close gives back the shared Lookup.
+// The underlying database is closed when the last reference is closed.
+func (s *shared) Close() error {
+	var err error
+
+	s.once.Do(func() {
+		err = s.entry.release()
+	})
+
+	return err
+}
+
+// fingerprint returns the SHA-256 hex digest and the size of the database of the given spec,
+// with the hashed file left open for parsing (nil for embedded assets).
+// Names of registered schemes not backed by a file (e.g. inline databases) are hashed.
+func fingerprint(spec Spec) (string, int64, *os.File, error) {
+	name := spec.Name
+
+	switch spec.Scheme {
+	case "":
+		if a, err := embeddedAsset(name); err == nil {
+			return a.digest, int64(len(a.payload)), nil, nil
+		}
+	case SchemeEmbedded:
+		a, err := embeddedAsset(EmbeddedScheme + name)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		return a.digest, int64(len(a.payload)), nil, nil
+	}
+
+	f, err := os.Open(name)
+	switch {
+	case err == nil:
+	case spec.Scheme != "" && notFile(err):
+		sum := sha256.Sum256([]byte(name))
+		return hex.EncodeToString(sum[:]), int64(len(name)), nil, nil
+	case errors.Is(err, fs.ErrPermission):
+		return "", 0, nil, fmt.Errorf("%s: database not readable: %w", name, err)
+	default:
+		return "", 0, nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		_ = f.Close()
+		return "", 0, nil, fmt.Errorf("%s: hashing: %w", name, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, f, nil
+}
+
+// notFile returns true if the given open error means that the name cannot be a file.
+// Other errors (e.g. permission denied) are reported, a name may be a file the process cannot read.
+func notFile(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.ENAMETOOLONG)
+}
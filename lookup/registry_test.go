@@ -0,0 +1,197 @@
+package lookup_test
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+// A counted is a backend counting its opened and closed databases.
+type counted struct {
+	mu     sync.Mutex
+	opened map[string]int // Per database content.
+	closed map[string]int
+	block  map[string]chan struct{} // Blocks the opening of a database content until closed.
+	fail   error                    // Returned by the next opening.
+}
+
+func (c *counted) open(spec lookup.Spec) (lookup.Lookup, error) {
+	payload, err := os.ReadFile(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	content := string(payload)
+
+	c.mu.Lock()
+	block := c.block[content]
+	c.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err, c.fail = c.fail, nil; err != nil {
+		return nil, err
+	}
+
+	c.opened[content]++
+	return &countedLookup{counted: c, content: content}, nil
+}
+
+func (c *counted) count(m map[string]int, content string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return m[content]
+}
+
+// countedBackend is the backend of the counted scheme.
+var countedBackend *counted
+
+type countedLookup struct {
+	counted *counted
+	content string
+}
+
+func (l *countedLookup) Record(netip.Addr) (lookup.Record, error) {
+	return lookup.Record{Country: l.content}, nil
+}
+
+func (*countedLookup) Metadata() lookup.Metadata {
+	return lookup.Metadata{
+		Vendor:   "Counted",
+		Families: []string{lookup.FamilyIPv4, lookup.FamilyIPv6},
+		Fields:   []lookup.Field{lookup.FieldCountry},
+	}
+}
+
+func (l *countedLookup) Close() error {
+	l.counted.mu.Lock()
+	defer l.counted.mu.Unlock()
+
+	l.counted.closed[l.content]++
+	return nil
+}
+
+var registerCounted sync.Once
+
+func TestAcquire(t *testing.T) {
+	c := &counted{
+		opened: make(map[string]int),
+		closed: make(map[string]int),
+		block:  make(map[string]chan struct{}),
+	}
+	registerCounted.Do(func() {
+		lookup.Register("counted", func(spec lookup.Spec) (lookup.Lookup, error) {
+			return countedBackend.open(spec)
+		})
+	})
+	countedBackend = c
+
+	name := filepath.Join(t.TempDir(), "countries")
+	assert.NoError(t, os.WriteFile(name, []byte("fr"), 0o600))
+
+	country := func(l lookup.Lookup) string {
+		record, err := l.Record(netip.MustParseAddr("192.0.2.1"))
+		assert.NoError(t, err)
+		return record.Country
+	}
+
+	// Identical databases are shared.
+	l1, err := lookup.Acquire("counted:" + name)
+	assert.NoError(t, err)
+	l2, err := lookup.Acquire("counted:" + name + "?family=ipv4")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.count(c.opened, "fr"))
+
+	// And released with their last reference.
+	assert.NoError(t, l1.Close())
+	assert.NoError(t, l1.Close())
+	assert.Equal(t, 0, c.count(c.closed, "fr"))
+	assert.Equal(t, "fr", country(l2))
+
+	// A changed content is another database.
+	assert.NoError(t, os.WriteFile(name, []byte("de"), 0o600))
+
+	l3, err := lookup.Acquire("counted:" + name)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.count(c.opened, "de"))
+	assert.Equal(t, "de", country(l3))
+	assert.Equal(t, "fr", country(l2))
+
+	assert.NoError(t, l2.Close())
+	assert.Equal(t, 1, c.count(c.closed, "fr"))
+	assert.NoError(t, l3.Close())
+	assert.Equal(t, 1, c.count(c.closed, "de"))
+
+	// Concurrent acquisitions wait for the same opening, without blocking the other databases.
+	other := filepath.Join(t.TempDir(), "countries")
+	assert.NoError(t, os.WriteFile(other, []byte("it"), 0o600))
+	assert.NoError(t, os.WriteFile(name, []byte("es"), 0o600))
+
+	block := make(chan struct{})
+	c.mu.Lock()
+	c.block["es"] = block
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	lookups := make([]lookup.Lookup, 4)
+	for i := range lookups {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var err error
+			lookups[i], err = lookup.Acquire("counted:" + name)
+			assert.NoError(t, err)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		l, err := lookup.Acquire("counted:" + other)
+		if assert.NoError(t, err) {
+			assert.NoError(t, l.Close())
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "acquisition blocked by the opening of another database")
+	}
+
+	close(block)
+	wg.Wait()
+	assert.Equal(t, 1, c.count(c.opened, "es"))
+
+	for _, l := range lookups {
+		assert.Equal(t, "es", country(l))
+		assert.NoError(t, l.Close())
+	}
+	assert.Equal(t, 1, c.count(c.closed, "es"))
+
+	// Failed openings are not kept.
+	c.mu.Lock()
+	c.fail = errors.New("unavailable")
+	c.mu.Unlock()
+
+	_, err = lookup.Acquire("counted:" + name)
+	assert.EqualError(t, err, "unavailable")
+
+	l, err := lookup.Acquire("counted:" + name)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+	assert.Equal(t, 2, c.count(c.opened, "es"))
+}
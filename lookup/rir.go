@@ -0,0 +1,219 @@
+package lookup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VendorRIR is the vendor of RIR delegated-stats lookups.
+const VendorRIR = "RIR"
+
+// A rir is a Lookup backed by RIR delegated-stats files.
+type rir struct {
+	ranges ranges
+	meta   Metadata
+}
+
+// IsRIR returns true if the given database name is a RIR delegated-stats file
+// (e.g. delegated-ripencc-extended-latest).
+func IsRIR(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), "delegated-")
+}
+
+// OpenRIR opens one or more RIR delegated-stats files and returns a Lookup.
+// Both the regular and the extended formats are supported, asn records are ignored.
+func OpenRIR(names ...string) (Lookup, error) {
+	return openRIR(Spec{}, names...)
+}
+
+// openRIR opens the given RIR files of the spec, see openFile.
+func openRIR(spec Spec, names ...string) (Lookup, error) {
+	var spans []span
+	var labels []string
+	var registries []string
+	var builddate time.Time
+
+	for _, name := range names {
+		f, err := spec.openFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := readRIR(f, name)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		spans = append(spans, file.spans...)
+		labels = append(labels, file.labels...)
+		registries = append(registries, file.registry)
+		if file.date.After(builddate) {
+			builddate = file.date
+		}
+	}
+
+	// Records are not sorted across registries.
+	index := make([]int, len(spans))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		return spans[index[i]].from.Less(spans[index[j]].from)
+	})
+
+	sorted := make([]span, len(spans))
+	for i, j := range index {
+		sorted[i] = spans[j]
+	}
+
+	ranges, err := newRanges(sorted, func(i int) string {
+		return labels[index[i]]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rir{
+		ranges: ranges,
+		meta: Metadata{
+			Vendor:    VendorRIR,
+			Edition:   strings.Join(registries, "+"),
+			BuildDate: builddate,
+			Families:  ranges.families(),
+			Records:   len(ranges),
+			Fields:    []Field{FieldCountry},
+			Origin:    OriginFilesystem,
+			Name:      strings.Join(names, ","),
+		},
+	}, nil
+}
+
+func (l *rir) Record(ip netip.Addr) (Record, error) {
+	if !ip.IsValid() {
+		return Record{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	s, ok := l.ranges.find(ip)
+	if !ok {
+		return Record{}, nil
+	}
+
+	return Record{Country: s.country}, nil
+}
+
+func (l *rir) Metadata() Metadata {
+	return l.meta
+}
+
+func (l *rir) Close() error {
+	return nil
+}
+
+type rirFile struct {
+	registry string
+	date     time.Time
+	spans    []span
+	labels   []string
+}
+
+// readRIR parses a delegated-stats file:
+//
+//	version|registry|serial|records|startdate|enddate|UTCoffset
+//	registry|cc|type|start|value|date|status[|opaque-id]
+func readRIR(r io.Reader, name string) (rirFile, error) {
+	var file rirFile
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	header := true
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+
+		if header {
+			// Version line
+			header = false
+			if len(fields) < 7 {
+				return file, fmt.Errorf("%s:%d: invalid version line", name, line)
+			}
+
+			file.registry = fields[1]
+			file.date, _ = time.Parse("20060102", fields[5])
+			continue
+		}
+
+		if len(fields) < 7 || fields[1] == "*" || fields[2] == "asn" || fields[5] == "summary" {
+			continue // Summary or asn records
+		}
+
+		country := strings.ToLower(fields[1])
+		if country == "" || country == "zz" {
+			continue // Available or reserved
+		}
+
+		s, err := rirSpan(fields[2], fields[3], fields[4])
+		if err != nil {
+			return file, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+
+		s.country = country
+		file.spans = append(file.spans, s)
+		file.labels = append(file.labels, fmt.Sprintf("%s:%d", name, line))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return file, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return file, nil
+}
+
+// rirSpan parses an ipv4 range with its hosts count or an ipv6 range with its prefix length.
+func rirSpan(kind, start, value string) (span, error) {
+	from, err := netip.ParseAddr(start)
+	if err != nil {
+		return span{}, err
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return span{}, fmt.Errorf("invalid value: %w", err)
+	}
+
+	switch {
+	case kind == "ipv4" && from.Is4() && n > 0:
+		last := new(big.Int).SetBytes(from.AsSlice())
+		last.Add(last, new(big.Int).SetUint64(n-1))
+
+		to, err := decimalIP(last.String(), FamilyIPv4)
+		if err != nil {
+			return span{}, fmt.Errorf("range out of bounds: %s+%d", from, n)
+		}
+
+		return span{from: from, to: to}, nil
+	case kind == "ipv6" && from.Is6() && n <= 128:
+		prefix, err := from.Prefix(int(n))
+		if err != nil {
+			return span{}, err
+		}
+
+		return span{from: prefix.Addr(), to: lastAddr(prefix)}, nil
+	}
+
+	return span{}, fmt.Errorf("invalid %s record: %s|%s", kind, start, value)
+}
@@ -0,0 +1,62 @@
+package lookup_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenRIR(t *testing.T) {
+	l, err := lookup.OpenRIR(
+		"testdata/delegated-ripencc-extended-latest",
+		"testdata/delegated-apnic-extended-latest",
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m := l.Metadata()
+	assert.Equal(t, "ripencc+apnic", m.Edition)
+	assert.Equal(t, time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), m.BuildDate)
+	assert.Equal(t, []string{lookup.FamilyIPv4, lookup.FamilyIPv6}, m.Families)
+	assert.Equal(t, 6, m.Records)
+
+	tests := map[string]string{
+		"1.0.0.1":          "au",
+		"1.0.3.255":        "cn",
+		"1.0.4.1":          "", // available
+		"2.56.3.255":       "nl",
+		"2.56.4.0":         "",
+		"80.67.169.12":     "fr",
+		"80.67.192.0":      "",
+		"2001:200::1":      "jp",
+		"2001:200:e000::1": "", // reserved
+		"2001:910:800::12": "fr",
+	}
+
+	for ip, expected := range tests {
+		record, err := l.Record(netip.MustParseAddr(ip))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, record.Country, ip)
+	}
+
+	//
+
+	l, err = lookup.Open("testdata/delegated-apnic-extended-latest")
+	assert.NoError(t, err)
+	assert.Equal(t, lookup.VendorRIR, l.Metadata().Vendor)
+}
+
+func TestOpenRIR_Overlap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "delegated-arin-extended-latest")
+	err := os.WriteFile(filename, []byte("2.3|arin|20240501|1|19700101|20240430|-0400\narin|US|ipv4|1.0.1.0|256|20110101|allocated|x\n"), 0o644)
+	assert.NoError(t, err)
+
+	_, err = lookup.OpenRIR("testdata/delegated-apnic-extended-latest", filename)
+	assert.ErrorContains(t, err, filename+":2: range 1.0.1.0-1.0.1.255 overlaps 1.0.1.0-1.0.3.255 (testdata/delegated-apnic-extended-latest:8)")
+}
@@ -0,0 +1,184 @@
+package lookup
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Built-in spec schemes.
+const (
+	SchemeEmbedded    = "embedded"    // Database embedded in the code, e.g. embedded:IP2LOCATION-LITE-DB1.BIN
+	SchemeIP2location = "ip2location" // IP2Location BIN database, e.g. ip2location:/path/DB1.BIN
+	SchemeMMDB        = "mmdb"        // MaxMind DB database, e.g. mmdb:/path/GeoLite2-Country.mmdb
+	SchemeCSV         = "csv"         // CSV database, e.g. csv:/path/DB1.CSV
+	SchemeRIR         = "rir"         // Comma separated RIR delegated-stats files, e.g. rir:/path/delegated-ripencc-latest
+	SchemeCompact     = "compact"     // Compact database, e.g. compact:/path/DB1.gbdb
+	SchemeStatic      = "static"      // Inline CIDRs, e.g. static:203.0.113.0/24=FR,2001:db8::/32=DE
+)
+
+// VendorStatic is the vendor of inline databases (see SchemeStatic).
+const VendorStatic = "Static"
+
+// An Opener opens the database of a spec, the spec name is stripped from its scheme.
+type Opener func(spec Spec) (Lookup, error)
+
+// A backend is a registered spec scheme.
+type backend struct {
+	open    Opener
+	options map[string]bool // Options specific to the backend.
+}
+
+var schemes = struct {
+	sync.RWMutex
+	backends map[string]backend
+}{
+	backends: make(map[string]backend),
+}
+
+var schemeRegexp = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+func init() {
+	Register(SchemeEmbedded, openEmbedded)
+	Register(SchemeIP2location, openIP2locationSpec)
+	Register(SchemeMMDB, openMMDBSpec)
+	Register(SchemeCSV, openCSVSpec)
+	Register(SchemeRIR, func(spec Spec) (Lookup, error) {
+		return openRIR(spec, strings.Split(spec.Name, ",")...)
+	})
+	Register(SchemeCompact, func(spec Spec) (Lookup, error) {
+		payload, err := spec.readFile(spec.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return openCompact(payload, OriginFilesystem, spec.Name)
+	})
+	Register(SchemeStatic, openStatic)
+}
+
+// Register makes a database backend available for the specs prefixed by the given scheme (e.g. "redis:").
+// Options lists the spec options specific to the backend.
+// It panics if the scheme is invalid or already registered.
+func Register(scheme string, open Opener, options ...string) {
+	if !schemeRegexp.MatchString(scheme) || open == nil {
+		panic("lookup: invalid backend: " + scheme)
+	}
+
+	schemes.Lock()
+	defer schemes.Unlock()
+
+	if _, ok := schemes.backends[scheme]; ok {
+		panic("lookup: backend already registered: " + scheme)
+	}
+
+	b := backend{
+		open:    open,
+		options: make(map[string]bool),
+	}
+	for _, option := range options {
+		b.options[option] = true
+	}
+
+	schemes.backends[scheme] = b
+}
+
+// Schemes returns the sorted list of the registered schemes.
+func Schemes() []string {
+	schemes.RLock()
+	defer schemes.RUnlock()
+
+	var list []string
+	for scheme := range schemes.backends {
+		list = append(list, scheme)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+func lookupBackend(scheme string) (backend, bool) {
+	schemes.RLock()
+	defer schemes.RUnlock()
+
+	b, ok := schemes.backends[scheme]
+	return b, ok
+}
+
+// cutScheme splits the given name on its registered scheme.
+// Unregistered prefixes (e.g. Windows drive letters) are part of the name.
+func cutScheme(s string) (scheme, name string) {
+	scheme, name, ok := strings.Cut(s, ":")
+	if !ok || !schemeRegexp.MatchString(scheme) {
+		return "", s
+	}
+
+	if _, ok = lookupBackend(scheme); !ok {
+		return "", s
+	}
+
+	return scheme, name
+}
+
+func openEmbedded(spec Spec) (Lookup, error) {
+	name := EmbeddedScheme + spec.Name
+
+	payload, err := Embedded(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if isCompact(payload) {
+		return openCompact(payload, OriginEmbedded, name)
+	}
+
+	return openIP2location(memory{bytes.NewReader(payload)}, OriginEmbedded, name, spec.InMemory())
+}
+
+func openIP2locationSpec(spec Spec) (Lookup, error) {
+	if IsArchive(spec.Name) {
+		payload, entry, err := spec.extract()
+		if err != nil {
+			return nil, err
+		}
+
+		return openIP2location(memory{bytes.NewReader(payload)}, OriginArchive, spec.Name+"#"+entry, spec.InMemory())
+	}
+
+	f, err := spec.openFile(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openIP2location(f, OriginFilesystem, spec.Name, spec.InMemory())
+}
+
+// openStatic opens an inline list of comma separated CIDR=COUNTRY entries.
+func openStatic(spec Spec) (Lookup, error) {
+	var entries []OverrideEntry
+
+	for _, v := range strings.Split(spec.Name, ",") {
+		cidr, country, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid entry, expected CIDR=COUNTRY: %s", SchemeStatic, v)
+		}
+
+		entries = append(entries, OverrideEntry{
+			CIDR:    cidr,
+			Country: country,
+		})
+	}
+
+	l, err := NewOverride(entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", SchemeStatic, err)
+	}
+
+	l.(*override).meta.Vendor = VendorStatic
+	l.(*override).meta.Origin = OriginSpec
+	l.(*override).meta.Name = spec.Name
+	return l, nil
+}
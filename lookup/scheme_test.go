@@ -0,0 +1,190 @@
+package lookup_test
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fixed is a third-party backend answering the same record for all the IPs.
+type fixed struct {
+	record lookup.Record
+}
+
+func (l fixed) Record(netip.Addr) (lookup.Record, error) {
+	return l.record, nil
+}
+
+func (fixed) Metadata() lookup.Metadata {
+	return lookup.Metadata{
+		Vendor:   "Fixed",
+		Families: []string{lookup.FamilyIPv4, lookup.FamilyIPv6},
+		Fields:   []lookup.Field{lookup.FieldCountry, lookup.FieldASN},
+	}
+}
+
+func (fixed) Close() error {
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	lookup.Register("fixed", func(spec lookup.Spec) (lookup.Lookup, error) {
+		return fixed{record: lookup.Record{Country: spec.Name, ASN: spec.Options.Get("asn")}}, nil
+	}, "asn")
+
+	assert.Contains(t, lookup.Schemes(), "fixed")
+	assert.PanicsWithValue(t, "lookup: backend already registered: fixed", func() {
+		lookup.Register("fixed", func(lookup.Spec) (lookup.Lookup, error) { return nil, nil })
+	})
+
+	spec, err := lookup.ParseSpec("fixed:fr?asn=64496&priority=-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fixed", spec.Scheme)
+	assert.Equal(t, "fr", spec.Name)
+	assert.Equal(t, -1, spec.Priority())
+	assert.Equal(t, "fixed:fr?asn=64496&priority=-1", spec.String())
+
+	l, err := lookup.Open(spec.String())
+	assert.NoError(t, err)
+	record, err := l.Record(netip.MustParseAddr("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, lookup.Record{Country: "fr", ASN: "64496"}, record)
+
+	l, err = lookup.Acquire("fixed:fr?asn=64496&fields=asn&family=ipv6")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	assert.Equal(t, []string{lookup.FamilyIPv6}, l.Metadata().Families)
+	assert.Equal(t, []lookup.Field{lookup.FieldASN}, l.Metadata().Fields)
+
+	record, err = l.Record(netip.MustParseAddr("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.Equal(t, lookup.Record{ASN: "64496"}, record)
+
+	record, err = l.Record(netip.MustParseAddr("::ffff:192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, lookup.Record{}, record)
+
+	// Names that cannot be files are hashed, unreadable files are reported.
+	dir := t.TempDir()
+	file := filepath.Join(dir, "fr")
+	assert.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	for _, name := range []string{file + "/de", strings.Repeat("de", 200)} {
+		l, err := lookup.Open("fixed:" + name)
+		if assert.NoError(t, err, name) {
+			assert.NoError(t, l.Close())
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		assert.NoError(t, os.Chmod(file, 0))
+		_, err = lookup.Open("fixed:" + file)
+		assert.ErrorContains(t, err, file+": database not readable: ")
+	}
+
+	//
+
+	for s, message := range map[string]string{
+		"fixed:fr?inmemory=maybe": `fixed:fr?inmemory=maybe: invalid inmemory: strconv.ParseBool: parsing "maybe": invalid syntax`,
+		"fixed:fr?priority=high":  `fixed:fr?priority=high: invalid priority: strconv.Atoi: parsing "high": invalid syntax`,
+		"fixed:fr?fields=zip":     "fixed:fr?fields=zip: invalid fields: unknown field: zip",
+		"static:1.1.1.0/24?asn=1": "static:1.1.1.0/24?asn=1: unknown option: asn",
+		"fixed:":                  "fixed:: empty database name",
+	} {
+		_, err = lookup.ParseSpec(s)
+		assert.EqualError(t, err, message)
+	}
+
+	spec, err = lookup.ParseSpec(`C:\geoblock\IP2LOCATION-LITE-DB1.BIN`)
+	assert.NoError(t, err)
+	assert.Empty(t, spec.Scheme)
+}
+
+func TestOpen_Schemes(t *testing.T) {
+	dir := t.TempDir()
+
+	mmdb := filepath.Join(dir, "countries.mmdb")
+	err := os.WriteFile(mmdb, buildMMDB(t, map[string]string{
+		"1.1.1.0/24":    "US",
+		"2001:910::/32": "FR",
+	}), 0o600)
+	assert.NoError(t, err)
+
+	csv := filepath.Join(dir, "countries.txt")
+	err = os.WriteFile(csv, []byte("1.1.1.0,1.1.1.255,AU\n"), 0o600)
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		spec     string
+		describe string
+		records  map[string]string
+	}{
+		{
+			spec:     "mmdb:" + mmdb,
+			describe: "maxmind Test-Country filesystem " + mmdb + " (2024-05-01, ipv4+ipv6, 2 records, in memory)",
+			records: map[string]string{
+				"1.1.1.1":             "us",
+				"::ffff:1.1.1.1":      "us",
+				"1.1.2.1":             "",
+				"2001:910:800::12":    "fr",
+				"2606:4700:4700::111": "",
+			},
+		},
+		{
+			spec:     "csv:" + csv,
+			describe: "csv filesystem " + csv,
+			records: map[string]string{
+				"1.1.1.1": "au",
+			},
+		},
+		{
+			spec:     "static:1.1.1.0/24=DE,2001:910::/32=de",
+			describe: "static spec 1.1.1.0/24=DE,2001:910::/32=de (unknown date, ipv4+ipv6, 2 records)",
+			records: map[string]string{
+				"1.1.1.1":          "de",
+				"2001:910:800::12": "de",
+				"80.67.169.12":     "",
+			},
+		},
+	} {
+		l, err := lookup.Open(test.spec)
+		if !assert.NoError(t, err, test.spec) {
+			continue
+		}
+
+		assert.Contains(t, lookup.Describe(l), test.describe)
+		for ip, country := range test.records {
+			record, err := l.Record(netip.MustParseAddr(ip))
+			assert.NoError(t, err)
+			assert.Equal(t, country, record.Country, "%s: %s", test.spec, ip)
+		}
+
+		assert.NoError(t, l.Close())
+	}
+
+	// Data pointing to itself.
+	looping := buildMMDB(t, map[string]string{"1.1.1.0/24": "US"})
+	i := bytes.Index(looping, []byte("\xe1\x47country"))
+	copy(looping[i:], []byte{0x20, 0x00}) // Pointer to the offset 0.
+	assert.NoError(t, os.WriteFile(mmdb, looping, 0o600))
+
+	l, err := lookup.Open("mmdb:" + mmdb)
+	if assert.NoError(t, err) {
+		_, err = l.Record(netip.MustParseAddr("1.1.1.1"))
+		assert.EqualError(t, err, "data nested too deep")
+		assert.NoError(t, l.Close())
+	}
+
+	_, err = lookup.Open("static:1.1.1.0/24")
+	assert.EqualError(t, err, "static: invalid entry, expected CIDR=COUNTRY: 1.1.1.0/24")
+
+	_, err = lookup.Open("embedded:MISSING.BIN")
+	assert.Error(t, err)
+}
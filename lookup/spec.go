@@ -0,0 +1,322 @@
+package lookup
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Spec options.
+const (
+	OptionSHA256   = "sha256"   // Expected SHA-256 hex digest of the database.
+	OptionMinSize  = "minsize"  // Minimum size in bytes of the database.
+	OptionType     = "type"     // Expected database type (e.g. DB1 or DB1-IPV6).
+	OptionInMemory = "inmemory" // Compile ip2location databases in memory (countries only).
+	OptionPriority = "priority" // Lookup order, databases with a higher priority answer first (default 0).
+	OptionFamily   = "family"   // Only look up the given address family (ipv4 or ipv6).
+	OptionFields   = "fields"   // Comma separated fields the database is trusted for (e.g. country,asn).
+)
+
+// A Spec is a database specification: a name, optionally prefixed by a registered scheme (see Register)
+// and followed by query options and, for archives, the database entry.
+// Names without scheme are detected from their extension or content.
+//
+//	IP2LOCATION-LITE-DB1.IPV6.BIN?sha256=2c26b4...&minsize=1048576&type=DB1-IPV6
+//	IP2LOCATION-LITE-DB1.IPV6.BIN?inmemory=true
+//	IP2LOCATION-LITE-DB1.IPV6.BIN.ZIP#IP2LOCATION-LITE-DB1.IPV6.BIN
+//	mmdb:/path/GeoLite2-ASN.mmdb?fields=asn,isp&priority=10
+//	static:203.0.113.0/24=FR?family=ipv4
+type Spec struct {
+	Scheme  string // Empty when detected.
+	Name    string
+	Options url.Values
+	Entry   string // Database entry inside an archive.
+
+	file *pinned // Database file verified by verify, see openFile.
+}
+
+// A pinned is a database file opened once to be both verified and parsed,
+// so that a concurrent update (e.g. a rename) cannot swap it in between.
+type pinned struct {
+	*os.File
+	taken bool // Owned by a Lookup or a reader.
+}
+
+// ParseSpec parses the given database specification.
+func ParseSpec(s string) (Spec, error) {
+	s, entry, _ := strings.Cut(s, "#")
+	name, query, _ := strings.Cut(s, "?")
+	scheme, name := cutScheme(name)
+	if name == "" {
+		return Spec{}, fmt.Errorf("%s: empty database name", s)
+	}
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return Spec{}, fmt.Errorf("%s: invalid options: %w", s, err)
+	}
+
+	backend, _ := lookupBackend(scheme)
+
+	for option := range options {
+		switch option {
+		case OptionSHA256, OptionMinSize, OptionType:
+		case OptionInMemory:
+			if _, err := strconv.ParseBool(options.Get(option)); err != nil {
+				return Spec{}, fmt.Errorf("%s: invalid %s: %w", s, option, err)
+			}
+		case OptionPriority:
+			if _, err := strconv.Atoi(options.Get(option)); err != nil {
+				return Spec{}, fmt.Errorf("%s: invalid %s: %w", s, option, err)
+			}
+		case OptionFamily:
+			if v := options.Get(option); v != FamilyIPv4 && v != FamilyIPv6 {
+				return Spec{}, fmt.Errorf("%s: invalid %s: %s", s, option, v)
+			}
+		case OptionFields:
+			for _, field := range strings.Split(options.Get(option), ",") {
+				if !isField(Field(field)) {
+					return Spec{}, fmt.Errorf("%s: invalid %s: unknown field: %s", s, option, field)
+				}
+			}
+		default:
+			if !backend.options[option] {
+				return Spec{}, fmt.Errorf("%s: unknown option: %s", s, option)
+			}
+		}
+	}
+
+	return Spec{
+		Scheme:  scheme,
+		Name:    name,
+		Options: options,
+		Entry:   entry,
+	}, nil
+}
+
+// String returns the spec string.
+func (s Spec) String() string {
+	v := s.Name
+	if s.Scheme != "" {
+		v = s.Scheme + ":" + v
+	}
+	if len(s.Options) > 0 {
+		v += "?" + s.Options.Encode()
+	}
+	if s.Entry != "" {
+		v += "#" + s.Entry
+	}
+
+	return v
+}
+
+// InMemory returns true if the database should be compiled in memory.
+func (s Spec) InMemory() bool {
+	v, _ := strconv.ParseBool(s.Options.Get(OptionInMemory))
+	return v
+}
+
+// Priority returns the lookup order of the database, higher first.
+func (s Spec) Priority() int {
+	v, _ := strconv.Atoi(s.Options.Get(OptionPriority))
+	return v
+}
+
+// Verify verifies the database content against the spec options.
+// Archives are verified as a whole.
+func (s Spec) Verify() (digest string, err error) {
+	s, digest, err = s.verify()
+	if err != nil {
+		return "", err
+	}
+	s.release()
+
+	return digest, nil
+}
+
+// verify verifies the database like Verify and returns the spec pinned to the verified file, if any.
+// The pinned file is handed over by openFile and closed by release otherwise.
+func (s Spec) verify() (Spec, string, error) {
+	digest, size, f, err := fingerprint(s)
+	if err != nil {
+		return s, "", err
+	}
+
+	if err = s.VerifyContent(digest, size); err != nil {
+		if f != nil {
+			_ = f.Close()
+		}
+		return s, "", err
+	}
+
+	if f != nil {
+		s.file = &pinned{File: f}
+	}
+
+	return s, digest, nil
+}
+
+// openFile opens the given database file of the spec, the verified one when pinned.
+// The caller owns the returned file.
+func (s Spec) openFile(name string) (*os.File, error) {
+	if s.file == nil || s.file.taken || name != s.Name {
+		return os.Open(name)
+	}
+
+	s.file.taken = true
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		_ = s.file.Close()
+		return nil, err
+	}
+
+	return s.file.File, nil
+}
+
+// readFile reads the given database file of the spec, see openFile.
+func (s Spec) readFile(name string) ([]byte, error) {
+	f, err := s.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// release closes the pinned file when it has not been handed over.
+func (s Spec) release() {
+	if s.file != nil && !s.file.taken {
+		s.file.taken = true
+		_ = s.file.Close()
+	}
+}
+
+// VerifyContent verifies the digest and the size of the database against the spec options.
+func (s Spec) VerifyContent(digest string, size int64) error {
+	if expected := s.Options.Get(OptionSHA256); expected != "" && !strings.EqualFold(expected, digest) {
+		return fmt.Errorf("%s: sha256 mismatch: expected %s, got %s", s.Name, strings.ToLower(expected), digest)
+	}
+
+	if v := s.Options.Get(OptionMinSize); v != "" {
+		minsize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid minsize: %w", s.Name, err)
+		}
+
+		if size < minsize {
+			return fmt.Errorf("%s: database too small: %d bytes, expected at least %d bytes", s.Name, size, minsize)
+		}
+	}
+
+	return nil
+}
+
+// VerifyType verifies the database type against the spec options.
+func (s Spec) VerifyType(m Metadata) error {
+	expected := s.Options.Get(OptionType)
+	if expected == "" {
+		return nil
+	}
+
+	actual := m.Edition
+	for _, family := range m.Families {
+		if family == FamilyIPv6 {
+			actual += "-IPV6"
+		}
+	}
+
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("%s: database type mismatch: expected %s, got %s", s.Name, strings.ToUpper(expected), actual)
+	}
+
+	return nil
+}
+
+// restrict limits the given lookup to the address family and the fields of the spec.
+func (s Spec) restrict(l Lookup) Lookup {
+	family := s.Options.Get(OptionFamily)
+	fields := s.Options.Get(OptionFields)
+	if family == "" && fields == "" {
+		return l
+	}
+
+	r := &restricted{
+		Lookup: l,
+		family: family,
+	}
+	if fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			r.fields = append(r.fields, Field(field))
+		}
+	}
+
+	return r
+}
+
+// A restricted is a Lookup limited to an address family and trusted fields.
+type restricted struct {
+	Lookup
+	family string  // Empty for all families.
+	fields []Field // Empty for all fields.
+}
+
+// Record returns the trusted fields of the given IP, IPs of other families are not found.
+func (r *restricted) Record(ip netip.Addr) (Record, error) {
+	if r.family != "" && r.family != family(ip) {
+		return Record{}, nil
+	}
+
+	record, err := r.Lookup.Record(ip)
+	if err != nil || len(r.fields) == 0 {
+		return record, err
+	}
+
+	var trusted Record
+	for _, field := range r.fields {
+		trusted.set(field, record.Get(field))
+	}
+
+	return trusted, nil
+}
+
+// Metadata returns the metadata of the underlying database limited to the family and the trusted fields.
+func (r *restricted) Metadata() Metadata {
+	m := r.Lookup.Metadata()
+
+	if r.family != "" {
+		var families []string
+		for _, family := range m.Families {
+			if family == r.family {
+				families = append(families, family)
+			}
+		}
+		m.Families = families
+	}
+
+	if len(r.fields) > 0 {
+		var fields []Field
+		for _, field := range m.Fields {
+			for _, trusted := range r.fields {
+				if field == trusted {
+					fields = append(fields, field)
+				}
+			}
+		}
+		m.Fields = fields
+	}
+
+	return m
+}
+
+// family returns the address family of the given IP, IPv4-mapped addresses are IPv4.
+func family(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return FamilyIPv4
+	}
+
+	return FamilyIPv6
+}
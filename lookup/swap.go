@@ -0,0 +1,62 @@
+package lookup
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// A Swappable is a Lookup whose underlying lookup can be replaced while in use.
+type Swappable struct {
+	mu     sync.RWMutex
+	lookup Lookup
+	closed bool
+}
+
+// NewSwappable returns a new Swappable wrapping the given lookup.
+func NewSwappable(l Lookup) *Swappable {
+	return &Swappable{
+		lookup: l,
+	}
+}
+
+// Swap replaces the underlying lookup and closes the previous one once the in-flight lookups are done.
+// The given lookup is closed right away if the Swappable is closed.
+func (s *Swappable) Swap(l Lookup) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+
+	old := s.lookup
+	s.lookup = l
+	s.mu.Unlock()
+
+	return old.Close()
+}
+
+func (s *Swappable) Record(ip netip.Addr) (Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lookup.Record(ip)
+}
+
+func (s *Swappable) Metadata() Metadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lookup.Metadata()
+}
+
+func (s *Swappable) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	return s.lookup.Close()
+}
@@ -0,0 +1,186 @@
+package lookup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Special IPv6 ranges remapped to IPv4 (as ip2location does).
+var (
+	prefix6to4   = netip.MustParsePrefix("2002::/16")
+	prefixTeredo = netip.MustParsePrefix("2001::/32")
+)
+
+// A table is a compact in-memory country range table.
+// Only the start address of the ranges is stored, along with an index in the country table:
+// a range lasts until the next one and the first country is reserved for unknown ranges.
+type table struct {
+	v4        []uint32
+	v4country []uint16
+	v6        [][2]uint64 // High and low 64 bits.
+	v6country []uint16
+	countries []string
+	index     map[string]uint16 // Country indexes, only used while building.
+	meta      Metadata
+}
+
+func newTable(meta Metadata) *table {
+	return &table{
+		countries: []string{""},
+		index:     map[string]uint16{"": 0},
+		meta:      meta,
+	}
+}
+
+// span adds the range from-to, ranges must be added in order.
+func (t *table) span(from, to netip.Addr, country string) error {
+	if err := t.start(from, country); err != nil {
+		return err
+	}
+
+	if next := to.Next(); next.IsValid() {
+		return t.start(next, "")
+	}
+
+	return nil
+}
+
+// start starts a new range at the given address, ranges must be added in order.
+// Adjacent ranges of the same country are merged.
+func (t *table) start(from netip.Addr, country string) error {
+	c, ok := t.index[country]
+	if !ok {
+		if len(t.countries) > 0xffff {
+			return fmt.Errorf("too many countries")
+		}
+
+		c = uint16(len(t.countries))
+		t.index[country] = c
+		t.countries = append(t.countries, country)
+	}
+
+	if from.Is4() {
+		b := from.As4()
+		t.v4, t.v4country = merge4(t.v4, t.v4country, binary.BigEndian.Uint32(b[:]), c)
+		return nil
+	}
+
+	b := from.As16()
+	t.v6, t.v6country = merge6(t.v6, t.v6country, [2]uint64{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}, c)
+	return nil
+}
+
+func merge4(starts []uint32, countries []uint16, from uint32, c uint16) ([]uint32, []uint16) {
+	n := len(starts)
+	if n > 0 && starts[n-1] == from {
+		// The previous range is empty.
+		starts, countries, n = starts[:n-1], countries[:n-1], n-1
+	}
+
+	if n == 0 && c == 0 || n > 0 && countries[n-1] == c {
+		return starts, countries
+	}
+
+	return append(starts, from), append(countries, c)
+}
+
+func merge6(starts [][2]uint64, countries []uint16, from [2]uint64, c uint16) ([][2]uint64, []uint16) {
+	n := len(starts)
+	if n > 0 && starts[n-1] == from {
+		starts, countries, n = starts[:n-1], countries[:n-1], n-1
+	}
+
+	if n == 0 && c == 0 || n > 0 && countries[n-1] == c {
+		return starts, countries
+	}
+
+	return append(starts, from), append(countries, c)
+}
+
+// build finalizes the table.
+func (t *table) build() *table {
+	t.index = nil
+
+	t.meta.Families = nil
+	if len(t.v4) > 0 {
+		t.meta.Families = append(t.meta.Families, FamilyIPv4)
+	}
+	if len(t.v6) > 0 {
+		t.meta.Families = append(t.meta.Families, FamilyIPv6)
+	}
+	t.meta.Records = len(t.v4) + len(t.v6)
+	t.meta.Fields = []Field{FieldCountry}
+	t.meta.InMemory = true
+
+	return t
+}
+
+func (t *table) Record(ip netip.Addr) (Record, error) {
+	if !ip.IsValid() {
+		return Record{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	ip = ip.Unmap()
+	if !ip.Is4() && len(t.v6) == 0 {
+		return Record{}, nil // IPv6 address missing in IPv4 database, 6to4 and Teredo included as in readers.
+	}
+
+	switch {
+	case ip.Is4():
+		b := ip.As4()
+		return t.record4(binary.BigEndian.Uint32(b[:])), nil
+	case prefix6to4.Contains(ip):
+		b := ip.As16()
+		return t.record4(binary.BigEndian.Uint32(b[2:])), nil
+	case prefixTeredo.Contains(ip):
+		b := ip.As16()
+		return t.record4(^binary.BigEndian.Uint32(b[12:])), nil
+	}
+
+	b := ip.As16()
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+
+	// Index of the first range starting after the IP.
+	i, j := 0, len(t.v6)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if from := t.v6[h]; hi < from[0] || hi == from[0] && lo < from[1] {
+			j = h
+		} else {
+			i = h + 1
+		}
+	}
+
+	if i == 0 {
+		return Record{}, nil
+	}
+
+	return Record{Country: t.countries[t.v6country[i-1]]}, nil
+}
+
+func (t *table) record4(ip uint32) Record {
+	i, j := 0, len(t.v4)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if ip < t.v4[h] {
+			j = h
+		} else {
+			i = h + 1
+		}
+	}
+
+	if i == 0 {
+		return Record{}
+	}
+
+	return Record{Country: t.countries[t.v4country[i-1]]}
+}
+
+func (t *table) Metadata() Metadata {
+	return t.meta
+}
+
+func (t *table) Close() error {
+	return nil
+}
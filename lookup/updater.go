@@ -0,0 +1,377 @@
+package lookup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPlaceholder is replaced by the download token in the updater URL.
+const TokenPlaceholder = "{token}"
+
+// Default updater values.
+const (
+	DefaultUpdateInterval = 24 * time.Hour
+	DefaultProbeIP        = "1.1.1.1"
+	DefaultProbeCountry   = "us"
+	minBackoff            = time.Minute
+)
+
+// MaxDownloadSize is the maximum size in bytes of a downloaded database, archived or not.
+const MaxDownloadSize int64 = 1 << 30
+
+// An Updater keeps a database file up to date from a remote URL and hot-swaps it.
+// Downloads use conditional GET requests and are verified before replacing the database.
+type Updater struct {
+	Name         string // Name used in logs.
+	Spec         Spec   // Database to keep up to date.
+	URL          string
+	Token        string
+	Interval     time.Duration
+	ProbeIP      string        // IP queried to verify the downloaded database.
+	ProbeCountry string        // Country expected for ProbeIP.
+	MaxAge       time.Duration // Age over which the database is reported as stale, not checked when zero.
+	Client       *http.Client
+
+	target  *Swappable
+	etag    string
+	modtime time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewUpdater returns a new Updater for the given spec, hot-swapping the target lookup.
+func NewUpdater(name string, spec Spec, url, token string, target *Swappable) *Updater {
+	u := &Updater{
+		Name:         name,
+		Spec:         spec,
+		URL:          url,
+		Token:        token,
+		Interval:     DefaultUpdateInterval,
+		ProbeIP:      DefaultProbeIP,
+		ProbeCountry: DefaultProbeCountry,
+		Client:       &http.Client{Timeout: 5 * time.Minute},
+		target:       target,
+		stop:         make(chan struct{}),
+	}
+
+	if fi, err := os.Stat(spec.Name); err == nil {
+		u.modtime = fi.ModTime()
+	}
+
+	return u
+}
+
+// Start runs the updater in background until it is closed, the first update is checked right away.
+// On failure, attempts are retried with an exponential backoff bounded by the interval.
+func (u *Updater) Start() {
+	go func() {
+		first := minBackoff
+		if first > u.Interval {
+			first = u.Interval
+		}
+		backoff := first
+		delay := time.Duration(0)
+		checked := time.Now() // The database age is checked on start by the caller.
+
+		for {
+			timer := time.NewTimer(delay)
+
+			select {
+			case <-u.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			updated, err := u.Update()
+
+			// The database is reported again while it is not updated.
+			if updated || time.Since(checked) >= u.Interval {
+				u.checkAge()
+				checked = time.Now()
+			}
+
+			if err == nil {
+				backoff = first
+				delay = u.Interval
+				continue
+			}
+
+			log.Printf("%s: %s: update failed, retrying in %s: %v", u.Name, u.Spec.Name, backoff, err)
+			delay = backoff
+			if backoff *= 2; backoff > u.Interval {
+				backoff = u.Interval
+			}
+		}
+	}()
+}
+
+// An updaterEntry is an updater started once and shared across the process.
+type updaterEntry struct {
+	key     string
+	updater *Updater
+	refs    int
+}
+
+// An updated is a reference to the lookup kept up to date by a shared updater.
+type updated struct {
+	Lookup
+	entry *updaterEntry
+	once  sync.Once
+}
+
+// Share starts the updater unless one of the same database with the same settings already runs in the process,
+// then the target of u is closed. It returns a reference to the lookup kept up to date by the running updater,
+// which is stopped when the last reference is closed.
+func (u *Updater) Share() Lookup {
+	key := strings.Join([]string{u.Spec.String(), u.URL, u.Token, u.Interval.String(), u.ProbeIP, u.ProbeCountry, u.MaxAge.String()}, "\n")
+
+	registry.Lock()
+	e, ok := registry.updaters[key]
+	if !ok {
+		e = &updaterEntry{
+			key:     key,
+			updater: u,
+		}
+		registry.updaters[key] = e
+		u.Start()
+	}
+	e.refs++
+	registry.Unlock()
+
+	if ok {
+		_ = u.target.Close()
+	}
+
+	return &updated{
+		Lookup: e.updater.target,
+		entry:  e,
+	}
+}
+
+// Close gives back the lookup of the shared updater.
+// The updater is stopped and its lookup closed when the last reference is closed.
+func (l *updated) Close() error {
+	var err error
+
+	l.once.Do(func() {
+		registry.Lock()
+		l.entry.refs--
+		last := l.entry.refs == 0
+		if last {
+			delete(registry.updaters, l.entry.key)
+		}
+		registry.Unlock()
+
+		if last {
+			_ = l.entry.updater.Close()
+			err = l.Lookup.Close()
+		}
+	})
+
+	return err
+}
+
+// checkAge warns when the target database is older than MaxAge.
+func (u *Updater) checkAge() {
+	builddate := u.target.Metadata().BuildDate
+	if u.MaxAge == 0 || builddate.IsZero() {
+		return
+	}
+
+	if age := time.Since(builddate); age > u.MaxAge {
+		log.Printf("WARNING %s: %s: stale database %s: built %d days ago", u.Name, u.Spec.Name, Describe(u.target), int(age.Hours()/24))
+	}
+}
+
+// Close stops the updater.
+func (u *Updater) Close() error {
+	u.once.Do(func() {
+		close(u.stop)
+	})
+
+	return nil
+}
+
+// Update performs a single update and returns true if the database has been replaced.
+func (u *Updater) Update() (bool, error) {
+	// The database file may have been replaced by another instance.
+	if fi, err := os.Stat(u.Spec.Name); err == nil && !fi.ModTime().Equal(u.modtime) {
+		if err = u.swap(); err != nil {
+			return false, err
+		}
+
+		log.Printf("%s: %s: reloaded from disk", u.Name, u.Spec.Name)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(u.URL, TokenPlaceholder, u.Token), nil)
+	if err != nil {
+		return false, fmt.Errorf("downloading %s: invalid url", u.URL)
+	}
+
+	if u.etag != "" {
+		req.Header.Set("If-None-Match", u.etag)
+	}
+	if !u.modtime.IsZero() {
+		req.Header.Set("If-Modified-Since", u.modtime.UTC().Format(http.TimeFormat))
+	}
+
+	res, err := u.Client.Do(req)
+	if err != nil {
+		// The URL of the error holds the token, the URL template is reported instead.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+
+		return false, fmt.Errorf("downloading %s: %w", u.URL, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("downloading: unexpected status: %s", res.Status)
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(res.Body, MaxDownloadSize+1))
+	if err != nil {
+		return false, fmt.Errorf("downloading: %w", err)
+	}
+	if int64(len(payload)) > MaxDownloadSize {
+		return false, fmt.Errorf("downloading: larger than %d bytes", MaxDownloadSize)
+	}
+
+	if err = u.write(payload); err != nil {
+		return false, err
+	}
+
+	if lastmod, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		_ = os.Chtimes(u.Spec.Name, lastmod, lastmod)
+	}
+
+	if err = u.swap(); err != nil {
+		return false, err
+	}
+
+	u.etag = res.Header.Get("ETag")
+	log.Printf("%s: %s: updated to %s", u.Name, u.Spec.Name, Describe(u.target))
+
+	return true, nil
+}
+
+// write verifies the downloaded payload and atomically replaces the database file.
+func (u *Updater) write(payload []byte) error {
+	var err error
+
+	switch {
+	case bytes.HasPrefix(payload, []byte("PK\x03\x04")):
+		payload, _, err = Extract("download.zip", payload, u.Spec.Entry)
+	case bytes.HasPrefix(payload, []byte{0x1f, 0x8b}):
+		payload, _, err = Extract("download.gz", payload, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(u.Spec.Name), ".*."+filepath.Base(u.Spec.Name))
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = f.Write(payload); err != nil {
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+
+	if err = u.verify(f.Name()); err != nil {
+		return fmt.Errorf("verifying download: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+
+	return os.Rename(f.Name(), u.Spec.Name)
+}
+
+// verify checks the given database file against the spec options and the probe.
+func (u *Updater) verify(name string) error {
+	spec := u.Spec
+	spec.Name = name
+
+	spec, _, err := spec.verify()
+	if err != nil {
+		return err
+	}
+
+	l, err := open(spec)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return u.probe(l)
+}
+
+// probe checks that the given lookup answers ProbeCountry for ProbeIP.
+func (u *Updater) probe(l Lookup) error {
+	if r, ok := l.(*restricted); ok {
+		l = r.Lookup // The probe may be out of the spec family.
+	}
+
+	ip, err := netip.ParseAddr(u.ProbeIP)
+	if err != nil {
+		return fmt.Errorf("probing %s: %w", u.ProbeIP, err)
+	}
+
+	record, err := l.Record(ip)
+	if err != nil {
+		return fmt.Errorf("probing %s: %w", u.ProbeIP, err)
+	}
+
+	if !strings.EqualFold(record.Country, u.ProbeCountry) {
+		return fmt.Errorf("probing %s: got %q instead of %s, database is likely corrupted", u.ProbeIP, record.Country, u.ProbeCountry)
+	}
+
+	return nil
+}
+
+// swap replaces the target lookup by the database on disk once probed.
+func (u *Updater) swap() error {
+	fi, err := os.Stat(u.Spec.Name)
+	if err != nil {
+		return err
+	}
+
+	l, err := Acquire(u.Spec.String())
+	if err != nil {
+		return err
+	}
+
+	if err = u.probe(l); err != nil {
+		_ = l.Close()
+		return fmt.Errorf("verifying %s: %w", u.Spec.Name, err)
+	}
+
+	u.modtime = fi.ModTime()
+	return u.target.Swap(l)
+}
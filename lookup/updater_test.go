@@ -0,0 +1,33 @@
+package lookup_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdater_Update(t *testing.T) {
+	spec, err := lookup.ParseSpec(filepath.Join(t.TempDir(), "IP2LOCATION-LITE-DB1.BIN"))
+	assert.NoError(t, err)
+
+	// The download token never shows up in the errors, they are logged.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	for _, template := range []string{
+		srv.URL + "/download?token={token}&file=DB1LITEBIN",
+		"http://exa mple.com/download?token={token}",
+	} {
+		u := lookup.NewUpdater("geoblock", spec, template, "s3cr3t-t0k3n", nil)
+
+		_, err = u.Update()
+		if assert.Error(t, err, template) {
+			assert.Contains(t, err.Error(), "downloading "+template+": ")
+			assert.NotContains(t, err.Error(), "s3cr3t-t0k3n")
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package geoblock
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A matcher is a validated Match.
+type matcher struct {
+	paths   []func(path string) bool
+	hosts   []string // Lowercased, with *. wildcards.
+	methods map[string]bool
+	headers []string
+}
+
+// newMatcher validates the given match, it returns nil when the match has no condition.
+// With exact, the paths without glob nor regular expression match exactly unless they end with a slash.
+func newMatcher(m Match, exact bool) (*matcher, error) {
+	if len(m.Paths) == 0 && len(m.Hosts) == 0 && len(m.Methods) == 0 && len(m.Headers) == 0 {
+		return nil, nil
+	}
+
+	c := &matcher{
+		methods: make(map[string]bool),
+		headers: m.Headers,
+	}
+
+	for _, pattern := range m.Paths {
+		fn, err := pathMatcher(pattern, exact)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", pattern, err)
+		}
+
+		c.paths = append(c.paths, fn)
+	}
+
+	for _, host := range m.Hosts {
+		c.hosts = append(c.hosts, strings.ToLower(host))
+	}
+
+	for _, method := range m.Methods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+
+	return c, nil
+}
+
+// pathMatcher returns the matcher of the given path pattern:
+// a regular expression prefixed by ~, a glob with * (one segment) and ** (any number of segments), or a prefix.
+// With exact, a plain pattern is a prefix only when it ends with a slash.
+func pathMatcher(pattern string, exact bool) (func(path string) bool, error) {
+	if strings.HasPrefix(pattern, "~") {
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		return re.MatchString, nil
+	}
+
+	if !strings.Contains(pattern, "*") {
+		if exact && !strings.HasSuffix(pattern, "/") {
+			return func(path string) bool {
+				return path == pattern
+			}, nil
+		}
+
+		return func(path string) bool {
+			return strings.HasPrefix(path, pattern)
+		}, nil
+	}
+
+	// /admin/** also matches /admin.
+	suffix := "$"
+	if strings.HasSuffix(pattern, "/**") {
+		pattern = strings.TrimSuffix(pattern, "/**")
+		suffix = "(/.*)?$"
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, part := range strings.Split(pattern, "**") {
+		if i > 0 {
+			expr.WriteString(".*")
+		}
+
+		for j, segment := range strings.Split(part, "*") {
+			if j > 0 {
+				expr.WriteString("[^/]*")
+			}
+			expr.WriteString(regexp.QuoteMeta(segment))
+		}
+	}
+	expr.WriteString(suffix)
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return re.MatchString, nil
+}
+
+// match returns true if the request matches all the conditions.
+// A nil matcher matches all the requests, a nil request only matches a nil matcher.
+func (m *matcher) match(r *http.Request) bool {
+	if m == nil {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+
+	if len(m.methods) > 0 && !m.methods[r.Method] {
+		return false
+	}
+
+	if len(m.hosts) > 0 && !m.matchHost(r.Host) {
+		return false
+	}
+
+	for _, header := range m.headers {
+		if len(r.Header.Values(header)) == 0 {
+			return false
+		}
+	}
+
+	if len(m.paths) == 0 {
+		return true
+	}
+
+	p := cleanPath(r.URL.Path)
+	for _, fn := range m.paths {
+		if fn(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cleanPath returns the canonical form of the given request path, as the backends resolve it:
+// rooted, without dot segments nor repeated slashes (e.g. //admin or /x/../admin), keeping the trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+
+	return clean
+}
+
+func (m *matcher) matchHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, pattern := range m.hosts {
+		if pattern == host {
+			return true
+		}
+
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,17 +5,38 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mdouchement/geoblock/lookup"
 )
 
+// Stats are the request counters of a plugin instance.
+type Stats struct {
+	Requests   uint64 // Evaluated requests.
+	Blocked    uint64 // Blocked requests, including the ones forwarded in monitor mode.
+	Monitored  uint64 // Blocked requests forwarded in monitor mode or blocked by a monitor rule only.
+	Bypassed   uint64 // Requests forwarded without evaluation (bypass list or token), not counted in Requests.
+	Challenged uint64 // Challenge pages served, included in Blocked.
+	Errors     uint64 // Evaluation errors (e.g. invalid IP), blocked unless in monitor mode.
+}
+
 // A Plugin is the struct used by Traefik to execute custom actions.
 type Plugin struct {
 	Config
 	name      string
 	next      http.Handler
 	evaluator *Evaluator
+	stats     *Stats
+	page      *blockPage
+	bypasses  []bypass
+	tokens    *tokens
+	challenge *challenge
+	lookups   []lookup.Lookup // Owned by the evaluator once created.
 }
 
 // New creates a new plugin instance.
@@ -36,13 +57,18 @@ func New(_ context.Context, next http.Handler, c *Config, name string) (http.Han
 		Config: *c,
 		name:   name,
 		next:   next,
+		stats:  new(Stats),
 	}
 
-	if !c.Enabled {
+	if !c.Enabled && !c.Enrichment.Enabled {
 		log.Printf("%s: disabled", name)
 		return p, nil
 	}
 
+	if c.Mode != "" && c.Mode != ModeEnforce && c.Mode != ModeMonitor {
+		return nil, fmt.Errorf("%s: invalid mode: %s", name, c.Mode)
+	}
+
 	if http.StatusText(c.DisallowedStatusCode) == "" {
 		return nil, fmt.Errorf("%s: %d is not a valid http status code", name, c.DisallowedStatusCode)
 	}
@@ -51,99 +77,518 @@ func New(_ context.Context, next http.Handler, c *Config, name string) (http.Han
 		return nil, fmt.Errorf("%s: no database file path configured", name)
 	}
 
-	//
+	if c.Enrichment.TrustedHops < 0 {
+		return nil, fmt.Errorf("%s: enrichment: invalid trusted hops: %d", name, c.Enrichment.TrustedHops)
+	}
 
-	var err error
+	maxage, err := parseDuration(c.MaxDatabaseAge)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid max database age: %w", name, err)
+	}
 
-	p.evaluator, err = NewEvaluator(name, *c)
+	p.page, err = newBlockPage(c.BlockPage)
 	if err != nil {
-		return nil, fmt.Errorf("%s: evaluator: %w", name, err)
+		return nil, fmt.Errorf("%s: block page: %w", name, err)
+	}
+
+	p.bypasses, err = newBypasses(*c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	p.tokens, err = newTokens(c.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: tokens: %w", name, err)
+	}
+
+	p.challenge, err = newChallenge(c.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%s: challenge: %w", name, err)
+	}
+	if p.challenge == nil && usesChallenge(*c) {
+		return nil, fmt.Errorf("%s: challenge action: missing challenge secret", name)
+	}
+
+	//
+
+	for _, filename := range c.Overrides {
+		l, err := lookup.OpenOverride(filename)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("%s: override: %w", name, err)
+		}
+
+		if err = p.addLookup(l, 0); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
 	}
 
 	for _, r := range c.DatabaseReaders {
-		lookup, err := lookup.OpenIP2locationReader(r)
+		open := lookup.OpenIP2locationReader
+		if c.InMemory {
+			open = lookup.CompileIP2locationReader
+		}
+
+		l, err := open(r)
 		if err != nil {
+			_ = p.Close()
 			return nil, fmt.Errorf("%s: ip2location: %w", name, err)
 		}
 
-		p.evaluator.AddLookup(lookup)
+		if err = p.addLookup(l, maxage); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
 	}
 
 	if len(c.DatabaseReaders) == 0 {
-		for _, databasename := range c.Databases {
-			lookup, err := lookup.OpenIP2location(databasename)
+		specs := make([]lookup.Spec, len(c.Databases))
+		for i, databasename := range c.Databases {
+			if specs[i], err = p.spec(databasename); err != nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("%s: %s: database: %w", name, databasename, err)
+			}
+		}
+
+		// Databases with a higher priority answer first, in configuration order otherwise.
+		order := make([]int, len(specs))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return specs[order[i]].Priority() > specs[order[j]].Priority()
+		})
+
+		for _, i := range order {
+			databasename, spec := c.Databases[i], specs[i]
+
+			l, err := lookup.Acquire(spec.String())
 			if err != nil {
-				return nil, fmt.Errorf("%s: %s: ip2location: %w", name, databasename, err)
+				_ = p.Close()
+				return nil, fmt.Errorf("%s: %s: database: %w", name, databasename, err)
 			}
 
-			p.evaluator.AddLookup(lookup)
+			if u, ok := p.update(databasename); ok {
+				l, err = p.addUpdater(spec, l, u, maxage)
+				if err != nil {
+					_ = p.Close()
+					return nil, fmt.Errorf("%s: %s: update: %w", name, databasename, err)
+				}
+			}
+
+			if err = p.addLookup(l, maxage); err != nil {
+				_ = p.Close()
+				return nil, err
+			}
+		}
+	}
+
+	for _, u := range c.DatabaseUpdates {
+		if !p.hasDatabase(u.Database) {
+			_ = p.Close()
+			return nil, fmt.Errorf("%s: %s: update: not listed in databases", name, u.Database)
 		}
 	}
 
+	p.evaluator, err = NewEvaluator(name, *c, p.lookups...)
+	if err != nil {
+		_ = p.Close()
+		return nil, fmt.Errorf("%s: evaluator: %w", name, err)
+	}
+
+	// Traefik never closes the middlewares, nor tells when an instance is dropped (e.g. on configuration reload).
+	runtime.SetFinalizer(p, (*Plugin).Close)
+
 	return p, err
 }
 
+// Close implements the io.Closer interface, dropped instances are closed when garbage collected.
+// Databases are released once the in-flight requests are done, shared ones with their last instance.
+func (p *Plugin) Close() error {
+	runtime.SetFinalizer(p, nil)
+
+	if p.evaluator == nil {
+		for _, l := range p.lookups {
+			_ = l.Close()
+		}
+
+		return nil
+	}
+
+	return p.evaluator.Close()
+}
+
+func (p *Plugin) update(database string) (DatabaseUpdate, bool) {
+	for _, u := range p.DatabaseUpdates {
+		if u.Database == database {
+			return u, true
+		}
+	}
+
+	return DatabaseUpdate{}, false
+}
+
+// spec parses the given database spec and applies the plugin defaults.
+func (p *Plugin) spec(database string) (lookup.Spec, error) {
+	spec, err := lookup.ParseSpec(database)
+	if err != nil {
+		return lookup.Spec{}, err
+	}
+
+	if p.InMemory && !spec.Options.Has(lookup.OptionInMemory) {
+		spec.Options.Set(lookup.OptionInMemory, "true")
+	}
+
+	return spec, nil
+}
+
+func (p *Plugin) hasDatabase(database string) bool {
+	for _, databasename := range p.Databases {
+		if databasename == database {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addUpdater wraps the given lookup to be hot-swapped by a new database updater.
+func (p *Plugin) addUpdater(spec lookup.Spec, l lookup.Lookup, c DatabaseUpdate, maxage time.Duration) (lookup.Lookup, error) {
+	var err error
+
+	if spec.Options.Get(lookup.OptionSHA256) != "" {
+		_ = l.Close()
+		return nil, fmt.Errorf("a database pinned by its sha256 cannot be updated")
+	}
+
+	if l.Metadata().Origin != lookup.OriginFilesystem {
+		_ = l.Close()
+		return nil, fmt.Errorf("only uncompressed database files can be updated")
+	}
+
+	u := lookup.NewUpdater(p.name, spec, c.URL, c.Token, lookup.NewSwappable(l))
+
+	if c.Interval != "" {
+		if u.Interval, err = parseDuration(c.Interval); err != nil || u.Interval <= 0 {
+			_ = l.Close()
+			return nil, fmt.Errorf("invalid interval: %s", c.Interval)
+		}
+	}
+	if c.ProbeIP != "" {
+		u.ProbeIP = c.ProbeIP
+	}
+	if c.ProbeCountry != "" {
+		u.ProbeCountry = c.ProbeCountry
+	}
+	u.MaxAge = maxage
+
+	// The updaters are shared by the instances, they would download the same file otherwise.
+	return u.Share(), nil
+}
+
+// addLookup adds the given lookup for the evaluator and checks its database freshness.
+// It warns or fails when the database is older than maxage.
+func (p *Plugin) addLookup(l lookup.Lookup, maxage time.Duration) error {
+	log.Printf("%s: loaded %s", p.name, lookup.Describe(l))
+	p.lookups = append(p.lookups, l)
+
+	builddate := l.Metadata().BuildDate
+	if maxage == 0 || builddate.IsZero() {
+		return nil
+	}
+
+	age := time.Since(builddate)
+	if age <= maxage {
+		return nil
+	}
+
+	err := fmt.Errorf("%s: stale database %s: built %d days ago", p.name, lookup.Describe(l), int(age.Hours()/24))
+	if p.RefuseStaleDatabases {
+		return err
+	}
+
+	log.Printf("WARNING %v", err)
+	return nil
+}
+
 // ServeHTTP implements the http.Handler interface.
-func (p Plugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (p *Plugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Enrichment.Enabled {
+		p.Enrichment.strip(r)
+	}
+
 	if !p.Enabled {
+		if p.Enrichment.Enabled {
+			p.enrich(r, "")
+		}
+
 		p.next.ServeHTTP(w, r)
 		return
 	}
 
-	if p.AllowLetsEncrypt && strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
-		// Allow Let's Encrypt HTTP challenge.
+	bypass := bypassed(p.bypasses, r) || p.bypassToken(r)
+	if p.tokens != nil {
+		// The tokens are credentials of the plugin, they are not forwarded.
+		p.tokens.strip(r)
+	}
+
+	if bypass {
+		atomic.AddUint64(&p.stats.Bypassed, 1)
+		if p.Enrichment.Enabled {
+			p.enrich(r, decisionBypass)
+		}
+
 		p.next.ServeHTTP(w, r)
 		return
 	}
 
-	for _, ip := range p.CollectIPs(r) {
-		allowed, country, err := p.evaluator.Evaluate(ip)
+	if p.challenge != nil && r.URL.Path == ChallengePath {
+		p.solve(w, r)
+		return
+	}
+
+	atomic.AddUint64(&p.stats.Requests, 1)
+
+	r = r.WithContext(withCrawlerBudget(r.Context()))
+	ips := p.CollectIPs(r)
+	clientIP := p.Enrichment.client(r, ips, p.evaluator.trustedIP)
+
+	var client Decision   // Decision of the client IP, see Enrichment.
+	var delayed *action   // Longest delay of the allowed IPs, applied once.
+	var allowed []*action // Actions of the allowed IPs, their headers are set once the request is forwarded.
+	decision := decisionAllow
+
+	for _, ip := range ips {
+		d, err := p.evaluator.EvaluateRequest(r, ip)
 		if err != nil {
 			log.Printf("%s: [%s %s %s] - %v", p.name, r.Host, r.Method, r.URL.Path, err)
-			w.WriteHeader(p.DisallowedStatusCode)
+			atomic.AddUint64(&p.stats.Errors, 1)
+
+			if p.Mode == ModeMonitor {
+				decision = decisionBlock
+				break
+			}
+
+			p.page.Write(w, r, newBlockPageData(r, p.DisallowedStatusCode, "", ip))
 			return
 		}
 
-		if !allowed {
-			log.Printf("%s: [%s %s %s] blocked request from %s (%s)", p.name, r.Host, r.Method, r.URL.Path, strings.ToUpper(country), ip)
-			w.WriteHeader(p.DisallowedStatusCode)
+		if ip == clientIP {
+			client = d
+		}
+
+		if t := d.Trial; t != nil {
+			if t.Allowed {
+				p.logDecision(r, "would allow", *t)
+			} else {
+				p.logDecision(r, "would block", *t)
+				if d.Allowed {
+					atomic.AddUint64(&p.stats.Monitored, 1)
+				}
+			}
+		}
+
+		if !d.Allowed && d.action.Type == ActionChallenge && p.challenge.passed(r, ip, d.action.Difficulty, time.Now()) {
+			continue
+		}
+
+		if !d.Allowed {
+			atomic.AddUint64(&p.stats.Blocked, 1)
+
+			if p.Mode == ModeMonitor {
+				p.logDecision(r, "would block", d)
+				atomic.AddUint64(&p.stats.Monitored, 1)
+				decision = decisionBlock
+				break
+			}
+
+			p.logDecision(r, "blocked", d)
+			p.block(w, r, d)
 			return
 		}
+
+		if delayed == nil || d.action.delay > delayed.delay {
+			delayed = d.action
+		}
+		allowed = append(allowed, d.action)
+	}
+
+	if delayed != nil && !delayed.wait(r) {
+		return
+	}
+
+	for _, a := range allowed {
+		a.setHeaders(w)
+	}
+
+	if p.Enrichment.Enabled {
+		p.Enrichment.enrich(r, client, decision)
 	}
 
 	p.next.ServeHTTP(w, r)
 }
 
+// enrich sets the enrichment headers of the request evaluated outside of the blocking
+// (blocking disabled or bypassed request), with the given decision or the evaluated one when empty.
+func (p *Plugin) enrich(r *http.Request, decision string) {
+	ip := p.Enrichment.client(r, p.CollectIPs(r), p.evaluator.trustedIP)
+	if ip == "" {
+		if decision == "" {
+			decision = decisionAllow
+		}
+
+		p.Enrichment.enrich(r, Decision{}, decision)
+		return
+	}
+
+	d, err := p.evaluator.EvaluateRequest(r, ip)
+	if err != nil {
+		log.Printf("%s: [%s %s %s] - %v", p.name, r.Host, r.Method, r.URL.Path, err)
+		return
+	}
+
+	switch {
+	case decision != "":
+	case d.Allowed:
+		decision = decisionAllow
+	default:
+		decision = decisionBlock
+	}
+
+	p.Enrichment.enrich(r, d, decision)
+}
+
+// bypassToken returns true if the request carries a valid bypass token, all the token uses are logged.
+func (p *Plugin) bypassToken(r *http.Request) bool {
+	if p.tokens == nil {
+		return false
+	}
+
+	token := p.tokens.find(r)
+	if token == "" {
+		return false
+	}
+
+	ips := strings.Join(p.CollectIPs(r), ", ")
+
+	claims, err := p.tokens.verify(token, time.Now())
+	if err != nil {
+		log.Printf("%s: [%s %s %s] rejected token from (%s)%s: %v", p.name, r.Host, r.Method, r.URL.Path, ips, claims.describe(), err)
+		return false
+	}
+
+	log.Printf("%s: [%s %s %s] bypassed request from (%s)%s", p.name, r.Host, r.Method, r.URL.Path, ips, claims.describe())
+	return true
+}
+
+// solve handles the solutions submitted by the challenge pages.
+func (p *Plugin) solve(w http.ResponseWriter, r *http.Request) {
+	ip, difficulty, err := p.challenge.solve(w, r, p.CollectIPs(r))
+	if err != nil {
+		log.Printf("%s: [%s %s %s] rejected challenge solution from (%s): %v", p.name, r.Host, r.Method, r.URL.Path, strings.Join(p.CollectIPs(r), ", "), err)
+		return
+	}
+
+	log.Printf("%s: [%s %s %s] solved challenge from (%s), difficulty %d", p.name, r.Host, r.Method, r.URL.Path, ip, difficulty)
+}
+
+// Stats returns the request counters.
+func (p *Plugin) Stats() Stats {
+	if p.stats == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Requests:   atomic.LoadUint64(&p.stats.Requests),
+		Blocked:    atomic.LoadUint64(&p.stats.Blocked),
+		Monitored:  atomic.LoadUint64(&p.stats.Monitored),
+		Bypassed:   atomic.LoadUint64(&p.stats.Bypassed),
+		Challenged: atomic.LoadUint64(&p.stats.Challenged),
+		Errors:     atomic.LoadUint64(&p.stats.Errors),
+	}
+}
+
+// logDecision logs the decision taken for the given request.
+func (p *Plugin) logDecision(r *http.Request, verb string, d Decision) {
+	log.Printf("%s: [%s %s %s] %s request from %s (%s)%s%s", p.name, r.Host, r.Method, r.URL.Path, verb, strings.ToUpper(d.Record.Country), d.IP, d.answeredBy(), d.matchedBy())
+}
+
+// block responds to a blocked request with the action of the decision.
+func (p *Plugin) block(w http.ResponseWriter, r *http.Request, d Decision) {
+	a := d.action
+	if !a.wait(r) {
+		return
+	}
+
+	a.setHeaders(w)
+	data := newBlockPageData(r, a.Status, d.Record.Country, d.IP)
+
+	switch a.Type {
+	case ActionRedirect:
+		if err := a.redirect(w, data); err != nil {
+			log.Printf("%s: [%s %s %s] - redirect: %v", p.name, r.Host, r.Method, r.URL.Path, err)
+			p.page.Write(w, r, newBlockPageData(r, p.DisallowedStatusCode, d.Record.Country, d.IP))
+		}
+
+		return
+	case ActionChallenge:
+		// Only browsers are able to solve challenges.
+		if negotiate(r.Header.Get("Accept")) == MediaTypeHTML {
+			atomic.AddUint64(&p.stats.Challenged, 1)
+			p.challenge.write(w, a.Status, d.IP, a.Difficulty, r.URL.RequestURI())
+			return
+		}
+	}
+
+	p.page.Write(w, r, data)
+}
+
 // CollectIPs collects the remote IPs from the X-Forwarded-For and X-Real-IP headers.
-func (p Plugin) CollectIPs(r *http.Request) []string {
-	m := make(map[string]bool)
+// IPs are deduplicated and kept in header order, the client IP first.
+func (p *Plugin) CollectIPs(r *http.Request) []string {
+	seen := make(map[string]bool)
+	var ips []string
 
-	if ips := r.Header.Get("X-Forwarded-For"); ips != "" {
-		for _, ip := range strings.Split(ips, ",") {
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		for _, ip := range strings.Split(r.Header.Get(header), ",") {
 			ip = strings.TrimSpace(ip)
-			if ip == "" {
+			if ip == "" || seen[ip] {
 				continue
 			}
 
-			m[ip] = true
+			seen[ip] = true
+			ips = append(ips, ip)
 		}
 	}
 
-	if ips := r.Header.Get("X-Real-IP"); ips != "" {
-		for _, ip := range strings.Split(ips, ",") {
-			ip = strings.TrimSpace(ip)
-			if ip == "" {
-				continue
-			}
+	return ips
+}
+
+// parseDuration parses a positive Go duration also accepting a number of days (e.g. 45d).
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
 
-			m[ip] = true
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
 		}
 	}
 
-	var ips []string
-	for k := range m {
-		ips = append(ips, k)
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration: %s", s)
 	}
 
-	return ips
+	return d, nil
 }
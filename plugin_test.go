@@ -3,19 +3,62 @@ package geoblock_test
 import (
 	"archive/zip"
 	"bytes"
-	"errors"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
+	"math/bits"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mdouchement/geoblock"
+	"github.com/mdouchement/geoblock/lookup"
+	"github.com/mdouchement/geoblock/lookup/ip2locationbin"
 	"github.com/stretchr/testify/assert"
 )
 
+// TestMain runs the tests in a directory holding the test databases.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "geoblock")
+	if err == nil {
+		err = fixtures(dir)
+	}
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type noopHandler struct{}
 
 func (n noopHandler) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
@@ -75,11 +118,16 @@ func TestPlugin_ServeHTTP(t *testing.T) {
 	}
 	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCountry, Value: "fr"})
 
-	err := check(c)
-	if err != nil {
-		assert.FailNow(t, err.Error())
+	for _, inmemory := range []bool{false, true} {
+		c.InMemory = inmemory
+
+		t.Run(fmt.Sprintf("inmemory=%t", inmemory), func(t *testing.T) {
+			testServeHTTP(t, c)
+		})
 	}
+}
 
+func testServeHTTP(t *testing.T, c *geoblock.Config) {
 	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
 	assert.NoError(t, err)
 
@@ -133,77 +181,1894 @@ func TestPlugin_ServeHTTP(t *testing.T) {
 	}
 }
 
-func check(c *geoblock.Config) error {
-	for _, dbname := range c.Databases {
-		_, err := os.Stat(dbname)
-		if err == nil || os.IsExist(err) {
+func TestPlugin_MaxDatabaseAge(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+
+	c.MaxDatabaseAge = "3650d"
+	c.RefuseStaleDatabases = true
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.(io.Closer).Close())
+
+	c.MaxDatabaseAge = "1h"
+	c.RefuseStaleDatabases = false
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	assert.NoError(t, plugin.(io.Closer).Close())
+
+	c.RefuseStaleDatabases = true
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.ErrorContains(t, err, "stale database")
+
+	c.MaxDatabaseAge = "one month"
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.ErrorContains(t, err, "invalid max database age")
+
+	c.MaxDatabaseAge = "-1d"
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: invalid max database age: negative duration: -1d")
+}
+
+func TestPlugin_DatabaseIntegrity(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.IPV6.BIN"}
+
+	payload, err := os.ReadFile(c.Databases[0])
+	assert.NoError(t, err)
+	digest := sha256.Sum256(payload)
+
+	tests := []struct {
+		options string
+		err     string
+	}{
+		{
+			options: fmt.Sprintf("sha256=%x&minsize=%d&type=DB1-IPV6", digest, len(payload)),
+		},
+		{
+			options: fmt.Sprintf("sha256=%X", digest),
+		},
+		{
+			options: "sha256=" + strings.Repeat("0", 64),
+			err:     "sha256 mismatch",
+		},
+		{
+			options: fmt.Sprintf("minsize=%d", len(payload)+1),
+			err:     "database too small",
+		},
+		{
+			options: "type=DB1",
+			err:     "database type mismatch",
+		},
+		{
+			options: "checksum=42",
+			err:     "unknown option",
+		},
+	}
+
+	for _, test := range tests {
+		c.Databases = []string{"IP2LOCATION-LITE-DB1.IPV6.BIN?" + test.options}
+
+		plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, test.options)
 			continue
 		}
 
-		err = download(
-			fmt.Sprintf("https://download.ip2location.com/lite/%s.ZIP", dbname),
-			dbname,
-		)
-		if err != nil {
-			return err
-		}
+		assert.NoError(t, err, test.options)
+		assert.NoError(t, plugin.(io.Closer).Close())
 	}
-
-	return nil
 }
 
-func download(url, filename string) error {
-	res, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("downloading db failed: %w", err)
+func TestPlugin_DatabaseArchives(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{
+		"IP2LOCATION-LITE-DB1.BIN",
+		"IP2LOCATION-LITE-DB1.IPV6.BIN",
 	}
-	defer res.Body.Close()
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCountry, Value: "fr"})
 
-	payload, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("downloading db failed: %w", err)
+	dir := t.TempDir()
+	archive(t, filepath.Join(dir, "db.zip"), c.Databases[1])
+	archive(t, filepath.Join(dir, "multi.zip"), c.Databases...)
+	archive(t, filepath.Join(dir, "IP2LOCATION-LITE-DB1.IPV6.BIN.gz"), c.Databases[1])
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		database string
+		loaded   string // Selected database.
+		allowed  string // FR
+		blocked  string // US
+		err      string
+	}{
+		{
+			database: filepath.Join(dir, "db.zip"),
+			loaded:   "ip2location DB1 archive " + filepath.Join(dir, "db.zip#IP2LOCATION-LITE-DB1.IPV6.BIN") + " (",
+			allowed:  "2001:910::1",
+			blocked:  "2606:4700:4700::1111",
+		},
+		{
+			database: filepath.Join(dir, "IP2LOCATION-LITE-DB1.IPV6.BIN.gz?type=DB1-IPV6"),
+			loaded:   "ip2location DB1 archive " + filepath.Join(dir, "IP2LOCATION-LITE-DB1.IPV6.BIN.gz#IP2LOCATION-LITE-DB1.IPV6.BIN") + " (",
+			allowed:  "2001:910::1",
+			blocked:  "2606:4700:4700::1111",
+		},
+		{
+			database: filepath.Join(dir, "multi.zip#IP2LOCATION-LITE-DB1.IPV6.BIN"),
+			loaded:   "ip2location DB1 archive " + filepath.Join(dir, "multi.zip#IP2LOCATION-LITE-DB1.IPV6.BIN") + " (",
+			allowed:  "2001:910::1",
+			blocked:  "2606:4700:4700::1111",
+		},
+		{
+			database: filepath.Join(dir, "multi.zip#IP2LOCATION-LITE-DB1.BIN"),
+			loaded:   "ip2location DB1 archive " + filepath.Join(dir, "multi.zip#IP2LOCATION-LITE-DB1.BIN") + " (",
+			allowed:  "80.67.169.12",
+			blocked:  "1.1.1.1",
+		},
+		{
+			database: filepath.Join(dir, "multi.zip"),
+			err:      "several databases found in archive",
+		},
+		{
+			database: filepath.Join(dir, "multi.zip#IP2LOCATION-LITE-DB3.BIN"),
+			err:      "entry not found in archive",
+		},
 	}
 
-	var r io.Reader = bytes.NewReader(payload)
-	if strings.HasSuffix(strings.ToLower(url), ".zip") {
-		r = nil
+	for _, test := range tests {
+		c.Databases = []string{test.database}
+		logs.Reset()
 
-		codec, err := zip.NewReader(bytes.NewReader(payload), res.ContentLength)
-		if err != nil {
-			return fmt.Errorf("creating zip reader: %w", err)
+		plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, test.database)
+			continue
 		}
 
-		for _, file := range codec.File {
-			if !strings.HasSuffix(strings.ToLower(file.Name), ".bin") {
-				continue
-			}
+		assert.NoError(t, err, test.database)
+		assert.Contains(t, logs.String(), test.loaded, test.database)
 
-			f, err := file.Open()
-			if err != nil {
-				return fmt.Errorf("opening zip db file: %w", err)
-			}
-			defer f.Close()
+		for ip, status := range map[string]int{test.allowed: http.StatusTeapot, test.blocked: http.StatusForbidden} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", ip)
 
-			r = f
+			rr := httptest.NewRecorder()
+			plugin.ServeHTTP(rr, req)
+			assert.Equal(t, status, rr.Code, test.database+" "+ip)
 		}
+
+		assert.NoError(t, plugin.(io.Closer).Close())
 	}
+}
 
-	if r == nil {
-		return errors.New("db file not found in downloaded archive")
+func TestPlugin_DatabaseUpdates(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{
+		"IP2LOCATION-LITE-DB1.BIN",
+		"IP2LOCATION-LITE-DB1.IPV6.BIN",
 	}
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCountry, Value: "fr"})
+
+	dir := t.TempDir()
+	archive(t, filepath.Join(dir, "fixture.zip"), c.Databases[1])
+	fixture, err := os.ReadFile(filepath.Join(dir, "fixture.zip"))
+	assert.NoError(t, err)
+
+	database := filepath.Join(dir, "IP2LOCATION-LITE-DB1.BIN")
+	payload, err := os.ReadFile(c.Databases[0])
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(database, payload, 0o644))
 
 	//
 
-	w, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("creating output file: %w", err)
+	var mu sync.Mutex
+	var requests []*http.Request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		n := len(requests)
+		mu.Unlock()
+
+		switch {
+		case r.URL.Query().Get("token") != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case n == 1:
+			w.Write([]byte("PK\x03\x04 truncated download")) // Triggers the backoff.
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(fixture)
+		}
+	}))
+	defer srv.Close()
+
+	c.Databases = []string{database}
+	c.DatabaseUpdates = []geoblock.DatabaseUpdate{
+		{
+			Database: database,
+			URL:      srv.URL + "/download?token={token}&file=DB1LITEBINIPV6",
+			Token:    "secret",
+			Interval: "20ms",
+		},
 	}
-	defer w.Close()
 
-	_, err = io.Copy(w, r)
-	if err != nil {
-		return fmt.Errorf("copy db to file: %w", err)
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "2001:910:800::12") // FR
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve()) // IPv4 only database
+	assert.Eventually(t, func() bool {
+		return serve() == http.StatusTeapot
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return requests[len(requests)-1].Header.Get("If-None-Match") == `"v1"`
+	}, 5*time.Second, 10*time.Millisecond)
+
+	l, err := lookup.OpenIP2location(database)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{lookup.FamilyIPv4, lookup.FamilyIPv6}, l.Metadata().Families)
+	assert.NoError(t, l.Close())
+
+	// A database replaced on disk is probed before being reloaded.
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	corrupted := filepath.Join(dir, "corrupted.csv")
+	assert.NoError(t, os.WriteFile(corrupted, []byte("1.1.1.0,1.1.1.255,FR\n"), 0o644))
+
+	var compact bytes.Buffer
+	assert.NoError(t, lookup.Convert(&compact, corrupted))
+	assert.NoError(t, os.WriteFile(corrupted, compact.Bytes(), 0o644))
+	modtime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(corrupted, modtime, modtime))
+	assert.NoError(t, os.Rename(corrupted, database))
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), `update failed, retrying in 20ms: verifying `+database+`: probing 1.1.1.1: got "fr" instead of us`)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusTeapot, serve())
+
+	// The instances share one updater, checking the database at startup.
+	assert.NoError(t, plugin.(io.Closer).Close())
+	c.DatabaseUpdates[0].Interval = "1h"
+	c.MaxDatabaseAge = "45d"
+
+	mu.Lock()
+	n := len(requests)
+	mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.NoError(t, err)
+		defer plugin.(io.Closer).Close()
+	}
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(requests) == n+1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	assert.Len(t, requests, n+1)
+	mu.Unlock()
+
+	// Updated databases are checked again.
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "WARNING geoblock: "+database+": stale database ip2location DB1 filesystem "+database+" (2024-05-01, ipv4+ipv6, ")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//
+
+	c.DatabaseUpdates[0].Database = "IP2LOCATION-LITE-DB1.IPV6.BIN"
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.ErrorContains(t, err, "not listed in databases")
+
+	payload, err = os.ReadFile(database)
+	assert.NoError(t, err)
+	c.Databases = []string{database + "?sha256=" + fmt.Sprintf("%x", sha256.Sum256(payload))}
+	c.DatabaseUpdates[0].Database = c.Databases[0]
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.ErrorContains(t, err, "update: a database pinned by its sha256 cannot be updated")
+}
+
+func TestPlugin_Overrides(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCountry, Value: "fr"})
+
+	c.Overrides = []string{filepath.Join(t.TempDir(), "overrides.yml")}
+	err := os.WriteFile(c.Overrides[0], []byte("- cidr: 1.1.1.0/24\n  country: FR\n- cidr: 80.67.169.12/32\n  country: US\n"), 0o644)
+	assert.NoError(t, err)
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		{
+			ip:     "1.1.1.1", // US in database
+			status: http.StatusTeapot,
+		},
+		{
+			ip:     "80.67.169.12", // FR in database
+			status: http.StatusForbidden,
+		},
+		{
+			ip:     "80.67.169.13", // FR in database
+			status: http.StatusTeapot,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", test.ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.ip)
+	}
+
+	assert.Contains(t, logs.String(), "blocked request from US (80.67.169.12) answered by override")
+
+	// Overrides answer for the whole record, the fields they lack are not filled by the databases.
+
+	w, err := ip2locationbin.NewWriter(ip2locationbin.DB3, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	err = w.Add(ip2locationbin.Range{
+		From:    netip.MustParseAddr("80.67.169.0"),
+		To:      netip.MustParseAddr("80.67.169.255"),
+		Country: "FR",
+		Region:  "Ile-de-France",
+		City:    "Paris",
+	})
+	assert.NoError(t, err)
+
+	var db3 bytes.Buffer
+	_, err = w.WriteTo(&db3)
+	assert.NoError(t, err)
+
+	c.Databases = []string{filepath.Join(t.TempDir(), "IP2LOCATION-LITE-DB3.BIN")}
+	assert.NoError(t, os.WriteFile(c.Databases[0], db3.Bytes(), 0o644))
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeRegion, Value: "Ile-de-France"}}
+
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	for ip, status := range map[string]int{
+		"80.67.169.12": http.StatusForbidden, // US without region in override
+		"80.67.169.13": http.StatusTeapot,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, status, rr.Code, ip)
+	}
+}
+
+func TestPlugin_RuleCapabilities(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Blocklist = append(c.Blocklist, geoblock.Rule{Type: geoblock.RuleTypeASN, Value: "AS13335"})
+
+	_, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, `geoblock: evaluator: geoblock: asn rule "AS13335": no database provides the asn field`)
+
+	//
+
+	c = geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeRegion, Value: "California"})
+
+	c.Overrides = []string{filepath.Join(t.TempDir(), "overrides.yml")}
+	err = os.WriteFile(c.Overrides[0], []byte("- cidr: 1.1.1.0/24\n  country: US\n  region: california\n"), 0o644)
+	assert.NoError(t, err)
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	assert.Contains(t, logs.String(), `WARNING geoblock: region rule "California": the region field is missing from ip2location DB1 filesystem IP2LOCATION-LITE-DB1.BIN`)
+
+	for ip, status := range map[string]int{
+		"1.1.1.1":      http.StatusTeapot,
+		"80.67.169.12": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, status, rr.Code, ip)
+	}
+}
+
+func TestPlugin_DatabaseSchemes(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{
+		"IP2LOCATION-LITE-DB1.BIN",
+		"ip2location:IP2LOCATION-LITE-DB1.IPV6.BIN?family=ipv6",
+		"static:1.1.1.0/24=FR,2606:4700::/32=FR?priority=10&family=ipv4",
+	}
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCountry, Value: "fr"})
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		{
+			ip:     "1.1.1.1", // US in database, FR in static
+			status: http.StatusTeapot,
+		},
+		{
+			ip:     "80.67.169.12", // FR in database
+			status: http.StatusTeapot,
+		},
+		{
+			ip:     "2001:910::1", // FR in IPv6 database
+			status: http.StatusTeapot,
+		},
+		{
+			ip:     "2606:4700::1111", // US in IPv6 database, static is IPv4 only
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", test.ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.ip)
 	}
 
-	return w.Sync()
+	assert.Contains(t, logs.String(), "blocked request from US (2606:4700::1111) answered by ip2location, action block 403\n")
+
+	_, err = geoblock.New(nil, new(noopHandler), &geoblock.Config{
+		Enabled:              true,
+		DefaultAction:        geoblock.DefaultActionBlock,
+		DisallowedStatusCode: http.StatusForbidden,
+		Databases:            []string{"static:1.1.1.0/24=FR?family=ipv5"},
+	}, "geoblock")
+	assert.EqualError(t, err, "geoblock: static:1.1.1.0/24=FR?family=ipv5: database: static:1.1.1.0/24=FR?family=ipv5: invalid family: ipv5")
+}
+
+func TestPlugin_BlockPage(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.BlockPage.HTML = `<p>{{.Country}} {{.Host}}</p>`
+	c.BlockPage.PlainFile = filepath.Join(t.TempDir(), "blocked.txt")
+	err := os.WriteFile(c.BlockPage.PlainFile, []byte("blocked {{.IP}} ({{.Country}}) {{.RequestID}}"), 0o644)
+	assert.NoError(t, err)
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			accept:      "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			contentType: "text/html; charset=utf-8",
+			body:        "<p>US &lt;script&gt;.example.com</p>",
+		},
+		{
+			accept:      "text/plain;q=0.5, application/json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"status":403,"error":"Forbidden","country":"US","ip":"1.1.1.1","request_id":"42",`,
+		},
+		{
+			accept:      "*/*;q=0.1, text/plain",
+			contentType: "text/plain; charset=utf-8",
+			body:        "blocked 1.1.1.1 (US) 42",
+		},
+		{
+			accept: "image/png",
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "<script>.example.com"
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		req.Header.Set("X-Request-Id", "42")
+		req.Header.Set("Accept", test.accept)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code, test.accept)
+		assert.Equal(t, "no-store, private", rr.Header().Get("Cache-Control"), test.accept)
+		assert.Equal(t, "Accept", rr.Header().Get("Vary"), test.accept)
+		assert.Equal(t, test.contentType, rr.Header().Get("Content-Type"), test.accept)
+		if test.body == "" {
+			assert.Empty(t, rr.Body.String(), test.accept)
+		} else {
+			assert.Contains(t, rr.Body.String(), test.body, test.accept)
+		}
+	}
+
+	// Default page with a generated request ID.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+
+	rr := httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+	assert.Len(t, rr.Header().Get("X-Request-Id"), 16)
+
+	//
+
+	c.BlockPage = geoblock.BlockPage{JSON: "{{.Unknown"}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.ErrorContains(t, err, "geoblock: block page: template: application/json:1: unclosed action")
+}
+
+func TestPlugin_RuleActions(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = []geoblock.Rule{
+		{
+			Type:   geoblock.RuleTypeCIDR,
+			Value:  "80.67.169.13/32",
+			Action: geoblock.Action{Delay: "20ms", Headers: map[string]string{"X-Geoblock": "trial"}},
+		},
+		{
+			Type:   geoblock.RuleTypeCIDR,
+			Value:  "80.67.169.14/31",
+			Action: geoblock.Action{Delay: "60ms"},
+		},
+	}
+	c.Blocklist = []geoblock.Rule{
+		{
+			Type:   geoblock.RuleTypeCIDR,
+			Value:  "80.67.169.12/32",
+			Action: geoblock.Action{Status: http.StatusUnavailableForLegalReasons, BlockedBy: "https://authority.example"},
+		},
+		{
+			Type:   geoblock.RuleTypeCountry,
+			Value:  "US",
+			Action: geoblock.Action{Type: geoblock.ActionRedirect, Status: http.StatusTemporaryRedirect, URL: "https://{{lower .Country}}.example.com{{.Path}}"},
+		},
+	}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/some%20path", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("1.1.1.1")
+	assert.Equal(t, http.StatusTemporaryRedirect, rr.Code)
+	assert.Equal(t, "https://us.example.com/some%20path", rr.Header().Get("Location"))
+	assert.Contains(t, logs.String(), `blocked request from US (1.1.1.1) answered by ip2location matched by country rule "US", action redirect 307`)
+
+	rr = serve("80.67.169.12")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rr.Code)
+	assert.Equal(t, `<https://authority.example>; rel="blocked-by"`, rr.Header().Get("Link"))
+	assert.Contains(t, rr.Body.String(), "Unavailable For Legal Reasons")
+
+	start := time.Now()
+	rr = serve("80.67.169.13")
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Equal(t, "trial", rr.Header().Get("X-Geoblock"))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// The headers of the allow actions are only set on forwarded requests.
+	rr = serve("80.67.169.13, 80.67.169.12")
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Geoblock"))
+
+	// Only the longest delay of the collected IPs applies.
+	start = time.Now()
+	rr = serve("80.67.169.13, 80.67.169.14, 80.67.169.15")
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 60*time.Millisecond)
+	assert.Less(t, elapsed, 140*time.Millisecond)
+
+	// Redirections can't leave the sites of the URL template.
+	c.Blocklist = []geoblock.Rule{
+		{
+			Type:   geoblock.RuleTypeCountry,
+			Value:  "US",
+			Action: geoblock.Action{Type: geoblock.ActionRedirect, URL: "{{.Path}}?id={{.RequestID}}"},
+		},
+	}
+
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	for _, test := range []struct {
+		target    string
+		requestID string
+		status    int
+		location  string
+	}{
+		{target: "/page", requestID: "42", status: http.StatusFound, location: "/page?id=42"},
+		{target: "//evil.example/", requestID: "42", status: http.StatusForbidden},
+		{target: "/page", requestID: "42\t//evil.example", status: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		req.Header.Set("X-Request-Id", test.requestID)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.target)
+		assert.Equal(t, test.location, rr.Header().Get("Location"), test.target)
+	}
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET //evil.example/] - redirect: invalid location "//evil.example/?id=42": scheme-relative`)
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /page] - redirect: invalid location "/page?id=42\t//evil.example": control character`)
+
+	//
+
+	for _, test := range []struct {
+		allowlist []geoblock.Rule
+		blocklist []geoblock.Rule
+		message   string
+	}{
+		{
+			blocklist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "us", Action: geoblock.Action{Type: geoblock.ActionRedirect}}},
+			message:   `geoblock: evaluator: geoblock: country rule "us": redirect action: missing url`,
+		},
+		{
+			blocklist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "us", Action: geoblock.Action{Type: geoblock.ActionRedirect, URL: "/", Status: 200}}},
+			message:   `geoblock: evaluator: geoblock: country rule "us": redirect action: invalid status: 200`,
+		},
+		{
+			allowlist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr", Action: geoblock.Action{Type: geoblock.ActionBlock}}},
+			message:   `geoblock: evaluator: geoblock: country rule "fr": unsupported action: block`,
+		},
+		{
+			allowlist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr", Action: geoblock.Action{Delay: "soon"}}},
+			message:   `geoblock: evaluator: geoblock: country rule "fr": allow action: invalid delay: soon`,
+		},
+	} {
+		c.Allowlist, c.Blocklist = test.allowlist, test.blocklist
+
+		_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.EqualError(t, err, test.message)
+	}
+}
+
+func TestPlugin_Monitor(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	serve := func(plugin http.Handler, ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Mode = geoblock.ModeMonitor
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	assert.Equal(t, http.StatusTeapot, serve(plugin, "1.1.1.1"))
+	assert.Equal(t, http.StatusTeapot, serve(plugin, "80.67.169.12"))
+	assert.Contains(t, logs.String(), "would block request from US (1.1.1.1) answered by ip2location, action block 403")
+	assert.Equal(t, geoblock.Stats{Requests: 2, Blocked: 1, Monitored: 1}, plugin.(*geoblock.Plugin).Stats())
+
+	// Evaluation errors are forwarded too.
+	assert.Equal(t, http.StatusTeapot, serve(plugin, "unknown"))
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] - geoblock: invalid IP address: unknown")
+	assert.Equal(t, geoblock.Stats{Requests: 3, Blocked: 1, Monitored: 1, Errors: 1}, plugin.(*geoblock.Plugin).Stats())
+
+	// Monitor rules inside an enforcing policy.
+	logs.Reset()
+
+	c.Mode = geoblock.ModeEnforce
+	c.Allowlist = append(c.Allowlist, geoblock.Rule{Type: geoblock.RuleTypeCIDR, Value: "1.1.1.0/24", Monitor: true})
+	c.Blocklist = append(c.Blocklist, geoblock.Rule{Type: geoblock.RuleTypeCIDR, Value: "80.67.169.0/24", Monitor: true})
+
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	assert.Equal(t, http.StatusForbidden, serve(plugin, "1.1.1.1"))
+	assert.Equal(t, http.StatusTeapot, serve(plugin, "80.67.169.12"))
+	assert.Equal(t, http.StatusForbidden, serve(plugin, "127.0.0.1"))
+	assert.Contains(t, logs.String(), `would allow request from US (1.1.1.1) answered by ip2location matched by cidr rule "1.1.1.0/24", action allow`)
+	assert.Contains(t, logs.String(), `would block request from FR (80.67.169.12) answered by ip2location matched by cidr rule "80.67.169.0/24", action block 403`)
+	assert.Equal(t, http.StatusForbidden, serve(plugin, "unknown"))
+	assert.Equal(t, geoblock.Stats{Requests: 4, Blocked: 2, Monitored: 1, Errors: 1}, plugin.(*geoblock.Plugin).Stats())
+
+	c.Mode = "dry-run"
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: invalid mode: dry-run")
+}
+
+func TestPlugin_Enrichment(t *testing.T) {
+	var forwarded http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	c := geoblock.CreateConfig()
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}}
+	c.Enrichment = geoblock.Enrichment{Enabled: true, Secret: "s3cret"}
+	c.TrustedProxies = []string{"80.67.169.0/24"}
+
+	plugin, err := geoblock.New(nil, next, c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 80.67.169.12")
+	req.Header.Set("X-Geo-Country", "FR")
+	req.Header.Set("x-geo-admin", "true")
+
+	rr := httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTeapot, rr.Code) // Blocking disabled.
+	assert.Equal(t, "1.1.1.1", forwarded.Get("X-Geo-IP"))
+	assert.Equal(t, "US", forwarded.Get("X-Geo-Country"))
+	assert.Equal(t, "block", forwarded.Get("X-Geo-Decision"))
+	assert.NotEmpty(t, forwarded.Get("X-Geo-Timestamp"))
+	assert.Empty(t, forwarded.Get("X-Geo-Admin"))
+	assert.Empty(t, forwarded.Get("X-Geo-Region"))
+	assert.Equal(t, geoblock.EnrichmentSignature(forwarded, "X-Geo-", "s3cret"), forwarded.Get("X-Geo-Signature"))
+
+	forwarded.Set("X-Geo-Country", "FR")
+	assert.NotEqual(t, geoblock.EnrichmentSignature(forwarded, "X-Geo-", "s3cret"), forwarded.Get("X-Geo-Signature"))
+
+	// Leftmost entries are spoofable, the client is the rightmost untrusted hop or the one before the trusted hops.
+	for _, test := range []struct {
+		xff     string
+		hops    int
+		ip      string
+		country string
+	}{
+		{xff: "80.67.169.1, 1.1.1.1", ip: "1.1.1.1", country: "US"},
+		{xff: "80.67.169.1, 1.1.1.1, 80.67.169.12", ip: "1.1.1.1", country: "US"},
+		{xff: "1.1.1.1, 80.67.169.1, 80.67.169.12", ip: "1.1.1.1", country: "US"}, // Only trusted proxies.
+		{xff: "80.67.169.1, 1.1.1.1, 10.0.0.1", hops: 1, ip: "1.1.1.1", country: "US"},
+		{xff: "1.1.1.1", hops: 2, ip: "1.1.1.1", country: "US"},
+	} {
+		c.Enrichment.TrustedHops = test.hops
+
+		plugin, err := geoblock.New(nil, next, c, "geoblock")
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", test.xff)
+
+		plugin.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, test.ip, forwarded.Get("X-Geo-IP"), test.xff)
+		assert.Equal(t, test.country, forwarded.Get("X-Geo-Country"), test.xff)
+		assert.NoError(t, plugin.(io.Closer).Close())
+	}
+	c.Enrichment.TrustedHops = 0
+
+	//
+
+	c.Enabled = true
+	c.Enrichment = geoblock.Enrichment{Enabled: true, Prefix: "X-Client-"}
+
+	plugin, err = geoblock.New(nil, next, c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Real-IP", "80.67.169.12")
+	req.Header.Set("X-Client-Decision", "allow")
+
+	plugin.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "FR", forwarded.Get("X-Client-Country"))
+	assert.Equal(t, "allow", forwarded.Get("X-Client-Decision"))
+	assert.Empty(t, forwarded.Get("X-Client-Signature"))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	req.Header.Set("X-Client-Decision", "allow")
+
+	forwarded = nil
+	rr = httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Nil(t, forwarded)
+
+	// Bypassed requests are enriched too.
+	c.Bypass = []geoblock.Bypass{{Name: "health", Match: geoblock.Match{Paths: []string{"/healthz"}}}}
+
+	plugin, err = geoblock.New(nil, next, c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	req = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	req.Header.Set("X-Client-Decision", "allow")
+
+	rr = httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Equal(t, "US", forwarded.Get("X-Client-Country"))
+	assert.Equal(t, "bypass", forwarded.Get("X-Client-Decision"))
+}
+
+func TestPlugin_Policies(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Policies = []geoblock.Policy{
+		{
+			Name:      "login",
+			Match:     geoblock.Match{Methods: []string{"post"}, Paths: []string{"/login"}},
+			Allowlist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}},
+		},
+		{
+			Name:      "admin",
+			Match:     geoblock.Match{Hosts: []string{"*.example.com"}, Paths: []string{"/admin/**", "/api/*/login", "~^/v[0-9]+/"}},
+			Allowlist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}},
+		},
+	}
+	c.Allowlist = []geoblock.Rule{
+		{Type: geoblock.RuleTypeCountry, Value: "fr"},
+		{Type: geoblock.RuleTypeCountry, Value: "us"},
+	}
+	c.Blocklist = []geoblock.Rule{
+		{Type: geoblock.RuleTypeCountry, Value: "us", Match: geoblock.Match{Headers: []string{"X-Debug"}}},
+	}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		method string
+		target string
+		header string
+		ip     string
+		status int
+	}{
+		{method: http.MethodPost, target: "/login", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "/login", ip: "80.67.169.12", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "/login", ip: "1.1.1.1", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "http://app.example.com:8080/admin", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/admin/users", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/administrator", ip: "1.1.1.1", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "http://app.example.com/api/v1/login", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/api/v1/sso/login", ip: "1.1.1.1", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "http://app.example.com/v2/users", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://example.org/admin", ip: "1.1.1.1", status: http.StatusTeapot},
+		// Paths are matched once cleaned.
+		{method: http.MethodGet, target: "http://app.example.com//admin/users", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/x/../admin", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/admin/./users/", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/admin/../public", ip: "1.1.1.1", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "http://app.example.com/api/v1//login", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/api/v1/sso/../login", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com/x/../v2/users", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "http://app.example.com//v2/users", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "/./login", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/", header: "X-Debug", ip: "1.1.1.1", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/", header: "X-Debug", ip: "80.67.169.12", status: http.StatusTeapot},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Header.Set("X-Forwarded-For", test.ip)
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, "%s %s %s", test.method, test.target, test.ip)
+	}
+
+	assert.Contains(t, logs.String(), `blocked request from US (1.1.1.1) answered by ip2location in policy "login", action block 403`)
+	assert.Contains(t, logs.String(), `blocked request from US (1.1.1.1) answered by ip2location matched by country rule "us", action block 403`)
+
+	//
+
+	c.Policies = []geoblock.Policy{{Match: geoblock.Match{Paths: []string{"~("}}}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: evaluator: geoblock: policy \"#1\": invalid path \"~(\": error parsing regexp: missing closing ): `(`")
+
+	c.Policies = []geoblock.Policy{{Name: "api", DefaultAction: "deny"}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, `geoblock: evaluator: geoblock: policy "api": invalid default action: deny`)
+}
+
+func TestPlugin_Bypass(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}}
+	c.Bypass = []geoblock.Bypass{
+		{Name: "health", Match: geoblock.Match{Methods: []string{"GET"}, Paths: []string{"/healthz", "/robots.txt", "/static/"}}},
+		{Name: "webhooks", Match: geoblock.Match{Paths: []string{"/hooks/*"}, Headers: []string{"X-Hub-Signature-256"}}},
+	}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	token := "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0"
+
+	tests := []struct {
+		method string
+		target string
+		header string
+		status int
+	}{
+		{method: http.MethodGet, target: "/.well-known/acme-challenge/" + token, status: http.StatusTeapot},
+		{method: http.MethodHead, target: "/.well-known/acme-challenge/" + token, status: http.StatusTeapot},
+		{method: http.MethodPost, target: "/.well-known/acme-challenge/" + token, status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/.well-known/acme-challenge/short", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/.well-known/acme-challenge/" + token + "/../../admin", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/.well-known/acme-challenge/" + token + ".php", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/healthz", status: http.StatusTeapot},
+		{method: http.MethodPost, target: "/healthz", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/robots.txt", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "/./robots.txt", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "/robots.txt/../admin", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/robots.txt.php", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/robots.txt/", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/static/app.js", status: http.StatusTeapot},
+		{method: http.MethodGet, target: "/static/../admin", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "/hooks/../admin", header: "X-Hub-Signature-256", status: http.StatusForbidden},
+		{method: http.MethodPost, target: "//hooks/github", header: "X-Hub-Signature-256", status: http.StatusTeapot},
+		{method: http.MethodPost, target: "/hooks/github", header: "X-Hub-Signature-256", status: http.StatusTeapot},
+		{method: http.MethodPost, target: "/hooks/github", status: http.StatusForbidden},
+		{method: http.MethodGet, target: "/", status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		if test.header != "" {
+			req.Header.Set(test.header, "sha256=0")
+		}
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, "%s %s", test.method, test.target)
+	}
+
+	assert.Equal(t, geoblock.Stats{Requests: 12, Blocked: 12, Bypassed: 8}, plugin.(*geoblock.Plugin).Stats())
+
+	//
+
+	c.AllowLetsEncrypt = false
+	c.Bypass = nil
+
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/"+token, nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	rr := httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	//
+
+	c.Bypass = []geoblock.Bypass{{Name: "all"}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, `geoblock: bypass "all": empty match`)
+
+	c.Bypass = []geoblock.Bypass{{Name: "spoofable", Match: geoblock.Match{Methods: []string{"POST"}, Headers: []string{"X-Hub-Signature-256"}}}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, `geoblock: bypass "spoofable": headers must be restricted to paths or hosts`)
+
+	c.Bypass = []geoblock.Bypass{{Match: geoblock.Match{Paths: []string{"~["}}}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: bypass \"#1\": invalid path \"~[\": error parsing regexp: missing closing ]: `[`")
+}
+
+func TestPlugin_Tokens(t *testing.T) {
+	current := geoblock.TokenKey{ID: "2024-06", Secret: "6aK1v3NqzV0mB8pX4rT2wY7cE5hJ9dLs"}
+	previous := geoblock.TokenKey{ID: "2024-05", Secret: "Qm3xW8nC1vB6zL0kJ4hG7fD2sA9pO5iU"}
+	retired := geoblock.TokenKey{ID: "2024-04", Secret: "Zr8tY2uI6oP0aS4dF1gH5jK9lX3cV7bN"}
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}}
+	c.Tokens = geoblock.Tokens{
+		Keys: []geoblock.TokenKey{current, previous},
+	}
+
+	var forwarded *http.Request
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	plugin, err := geoblock.New(nil, next, c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	expires := time.Now().Add(time.Hour)
+	issue := func(key geoblock.TokenKey, expires time.Time) string {
+		token, err := geoblock.IssueToken(key, "alice@example.com", expires)
+		assert.NoError(t, err)
+		return token
+	}
+
+	valid := issue(current, expires)
+	expired := issue(current, time.Now().Add(-time.Second))
+	tampered := strings.Replace(valid, ".", ".Ym9i", 1)
+	forged := url.QueryEscape(strings.Repeat("x", 40) + "\n2024/06/01 geoblock: bypassed.a.1.c")
+	cookies := "session=1; " + geoblock.DefaultTokenCookie + "=" + valid + "; theme=dark"
+
+	tests := []struct {
+		name   string
+		set    func(r *http.Request)
+		status int
+	}{
+		{name: "none", set: func(*http.Request) {}, status: http.StatusForbidden},
+		{name: "header", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, valid) }, status: http.StatusTeapot},
+		{name: "cookie", set: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: geoblock.DefaultTokenCookie, Value: valid}) }, status: http.StatusTeapot},
+		{name: "query", set: func(r *http.Request) { r.URL.RawQuery = geoblock.DefaultTokenQuery + "=" + valid }, status: http.StatusTeapot},
+		{name: "cookies", set: func(r *http.Request) { r.Header.Set("Cookie", cookies) }, status: http.StatusTeapot},
+		{name: "query parameters", set: func(r *http.Request) { r.URL.RawQuery = "page=2&" + geoblock.DefaultTokenQuery + "=" + valid }, status: http.StatusTeapot},
+		{name: "previous key", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, issue(previous, expires)) }, status: http.StatusTeapot},
+		{name: "retired key", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, issue(retired, expires)) }, status: http.StatusForbidden},
+		{name: "expired", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, expired) }, status: http.StatusForbidden},
+		{name: "tampered", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, tampered) }, status: http.StatusForbidden},
+		{name: "malformed", set: func(r *http.Request) { r.Header.Set(geoblock.DefaultTokenHeader, "alice") }, status: http.StatusForbidden},
+		{name: "forged key", set: func(r *http.Request) { r.URL.RawQuery = "geoblock_token=" + forged }, status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		test.set(req)
+
+		forwarded = nil
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.name)
+
+		// The backends never get the token.
+		if forwarded != nil {
+			assert.Empty(t, forwarded.Header.Get(geoblock.DefaultTokenHeader), test.name)
+			assert.NotContains(t, forwarded.Header.Get("Cookie"), geoblock.DefaultTokenCookie, test.name)
+			assert.False(t, forwarded.URL.Query().Has(geoblock.DefaultTokenQuery), test.name)
+			assert.NotContains(t, forwarded.RequestURI, valid, test.name)
+		}
+	}
+
+	assert.Equal(t, geoblock.Stats{Requests: 6, Blocked: 6, Bypassed: 6}, plugin.(*geoblock.Plugin).Stats())
+
+	at := expires.UTC().Format(time.RFC3339)
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] bypassed request from (1.1.1.1) with the token of "alice@example.com" (key 2024-06, expires `+at+")\n")
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] bypassed request from (1.1.1.1) with the token of "alice@example.com" (key 2024-05, expires `+at+")\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] rejected token from (1.1.1.1): unknown key: \"2024-04\"\n")
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] rejected token from (1.1.1.1) with the token of "alice@example.com" (key 2024-06, expires `)
+	assert.Contains(t, logs.String(), "): expired token\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] rejected token from (1.1.1.1): invalid signature\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] rejected token from (1.1.1.1): malformed token\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] rejected token from (1.1.1.1): unknown key: \"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx...\"\n")
+
+	req := httptest.NewRequest(http.MethodGet, "/?page=2&"+geoblock.DefaultTokenQuery+"="+valid+"&q=a+b%20c&a=1&sig=x%2Fy&empty&geoblock%5Ftoken="+valid, nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("Cookie", cookies)
+	plugin.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "session=1; theme=dark", forwarded.Header.Get("Cookie"))
+	assert.Equal(t, "page=2&q=a+b%20c&a=1&sig=x%2Fy&empty", forwarded.URL.RawQuery)
+	assert.Equal(t, "/?page=2&q=a+b%20c&a=1&sig=x%2Fy&empty", forwarded.RequestURI)
+
+	//
+
+	// The tokens of a key rotated out are rejected.
+	c.Tokens.Keys = []geoblock.TokenKey{current}
+
+	plugin, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	for key, status := range map[string]int{current.ID: http.StatusTeapot, previous.ID: http.StatusForbidden} {
+		token := valid
+		if key == previous.ID {
+			token = issue(previous, expires)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		req.Header.Set(geoblock.DefaultTokenHeader, token)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+		assert.Equal(t, status, rr.Code, key)
+	}
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] rejected token from (1.1.1.1): unknown key: \"2024-05\"\n")
+
+	//
+
+	_, err = geoblock.IssueToken(geoblock.TokenKey{ID: "2024.06", Secret: current.Secret}, "alice", expires)
+	assert.EqualError(t, err, `invalid key id: "2024.06"`)
+
+	_, err = geoblock.IssueToken(current, "", expires)
+	assert.EqualError(t, err, "empty subject")
+
+	c.Tokens.Keys = []geoblock.TokenKey{current, {ID: "2024-06", Secret: previous.Secret}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: tokens: duplicate key id: 2024-06")
+
+	c.Tokens.Keys = []geoblock.TokenKey{{ID: "short", Secret: "secret"}}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: tokens: key short: secret shorter than 32 bytes")
+}
+
+func TestPlugin_TokenTool(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the geoblock-token tool")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	key := geoblock.TokenKey{ID: "2024-06", Secret: "6aK1v3NqzV0mB8pX4rT2wY7cE5hJ9dLs"}
+
+	// The tests run in the fixtures directory.
+	_, file, _, _ := runtime.Caller(0)
+
+	cmd := exec.Command("go", "run", "./.tools/geoblock-token", "-key", key.ID, "-ttl", "1h", "bob@example.com")
+	cmd.Dir = filepath.Dir(file)
+	cmd.Env = append(os.Environ(), "GEOBLOCK_TOKEN_SECRET="+key.Secret)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Tokens.Keys = []geoblock.TokenKey{key}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set(geoblock.DefaultTokenHeader, strings.TrimSpace(string(out)))
+
+	rr := httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] bypassed request from (1.1.1.1) with the token of "bob@example.com" (key 2024-06, expires `)
+}
+
+func TestPlugin_CertRules(t *testing.T) {
+	certificate := func(issuer string, template x509.Certificate) *x509.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+
+		template.SerialNumber = big.NewInt(1)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		parent := &x509.Certificate{Subject: pkix.Name{CommonName: issuer}}
+
+		der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, key)
+		assert.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		return cert
+	}
+
+	spiffe, _ := url.Parse("spiffe://partner.example/billing")
+
+	partner := certificate("Partner CA", x509.Certificate{Subject: pkix.Name{CommonName: "api.partner.example", OrganizationalUnit: []string{"Partners"}}})
+	billing := certificate("Partner CA", x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, URIs: []*url.URL{spiffe}})
+	pinned := certificate("Other CA", x509.Certificate{Subject: pkix.Name{CommonName: "pinned"}})
+	vendor := certificate("Vendor CA", x509.Certificate{Subject: pkix.Name{CommonName: "vendor"}})
+	revoked := certificate("Partner CA", x509.Certificate{Subject: pkix.Name{CommonName: "api.partner.example", OrganizationalUnit: []string{"Revoked"}}})
+	intruder := certificate("Other CA", x509.Certificate{Subject: pkix.Name{CommonName: "intruder"}})
+
+	fingerprint := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.10"}
+	c.Allowlist = []geoblock.Rule{
+		{Type: geoblock.RuleTypeCountry, Value: "fr"},
+		{Type: geoblock.RuleTypeCert, Value: "cn:api.partner.example"},
+		{Type: geoblock.RuleTypeCert, Value: "san:spiffe://partner.example/billing"},
+		{Type: geoblock.RuleTypeCert, Value: "spki:" + base64.StdEncoding.EncodeToString(fingerprint[:])},
+		{Type: geoblock.RuleTypeCert, Value: "issuer:vendor ca"},
+	}
+	c.Blocklist = append(c.Blocklist,
+		geoblock.Rule{Type: geoblock.RuleTypeCIDR, Value: "1.1.1.0/24"},
+		geoblock.Rule{Type: geoblock.RuleTypeCert, Value: "ou:Revoked"},
+	)
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	forwarded := func(cert *x509.Certificate) string {
+		return url.QueryEscape(base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	delimited := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: partner.Raw})))
+
+	tests := []struct {
+		name       string
+		cert       *x509.Certificate
+		unverified bool
+		remote     string
+		header     string
+		status     int
+	}{
+		{name: "none", status: http.StatusForbidden},
+		{name: "partner", cert: partner, status: http.StatusTeapot},
+		{name: "billing", cert: billing, status: http.StatusTeapot},
+		{name: "pinned", cert: pinned, status: http.StatusTeapot},
+		{name: "vendor", cert: vendor, status: http.StatusTeapot},
+		{name: "revoked", cert: revoked, status: http.StatusForbidden},
+		{name: "intruder", cert: intruder, status: http.StatusForbidden},
+		{name: "unverified", cert: partner, unverified: true, status: http.StatusForbidden},
+		{name: "forwarded", remote: "10.1.2.3:4321", header: forwarded(partner) + "," + forwarded(intruder), status: http.StatusTeapot},
+		{name: "forwarded pem", remote: "192.0.2.10:4321", header: delimited, status: http.StatusTeapot},
+		{name: "forwarded intruder", remote: "10.1.2.3:4321", header: forwarded(intruder), status: http.StatusForbidden},
+		{name: "untrusted proxy", remote: "192.0.2.1:4321", header: forwarded(partner), status: http.StatusForbidden},
+		{name: "malformed", remote: "10.1.2.3:4321", header: "bm90IGEgY2VydGlmaWNhdGU", status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		if test.cert != nil {
+			req.TLS.PeerCertificates = []*x509.Certificate{test.cert}
+			if !test.unverified {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{test.cert}}
+			}
+		}
+		if test.remote != "" {
+			req.TLS = nil
+			req.RemoteAddr = test.remote
+			req.Header.Set(geoblock.DefaultClientCertHeader, test.header)
+		}
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.name)
+	}
+
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] blocked request from US (1.1.1.1) answered by ip2location matched by cert rule "ou:Revoked", action block 403`)
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /] blocked request from  (1.1.1.1) matched by cidr rule "1.1.1.0/24", action block 403`)
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /] - geoblock: client certificate: X-Forwarded-Tls-Client-Cert: ")
+
+	//
+
+	for value, message := range map[string]string{
+		"cn":        `geoblock: evaluator: geoblock: cert rule "cn": expected ATTRIBUTE:VALUE`,
+		"o:partner": `geoblock: evaluator: geoblock: cert rule "o:partner": unknown attribute: o`,
+		"spki:abcd": `geoblock: evaluator: geoblock: cert rule "spki:abcd": invalid sha256 fingerprint: abcd`,
+	} {
+		c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCert, Value: value}}
+		_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.EqualError(t, err, message)
+	}
+
+	c.Allowlist = nil
+	c.TrustedProxies = []string{"proxy.local"}
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: evaluator: geoblock: invalid trusted proxy: proxy.local")
+}
+
+// A fakeResolver answers the crawler verifications from static records and counts the lookups.
+type fakeResolver struct {
+	mu      sync.Mutex
+	ptr     map[string][]string
+	hosts   map[string][]string
+	delay   time.Duration
+	lookups int
+}
+
+func (r *fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	time.Sleep(r.delay)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups++
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	time.Sleep(r.delay)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestPlugin_CrawlerRules(t *testing.T) {
+	dir := t.TempDir()
+
+	ranges := filepath.Join(dir, "bingbot.json")
+	err := os.WriteFile(ranges, []byte(`{"creationTime":"2024-06-01T00:00:00","prefixes":[{"ipv4Prefix":"1.1.1.128/25"},{"ipv6Prefix":"2606:4700::/48"}]}`), 0o600)
+	assert.NoError(t, err)
+
+	resolver := &fakeResolver{
+		ptr: map[string][]string{
+			"1.1.1.1": {"crawl-1-1-1-1.googlebot.com."},
+			"1.1.1.2": {"crawl.googlebot.com.example.net."},
+			"1.1.1.3": {"crawl-1-1-1-3.googlebot.com."},
+			"1.1.1.5": {"a.googlebot.com.", "b.googlebot.com.", "c.googlebot.com.", "d.googlebot.com.", "e.googlebot.com.", "f.googlebot.com."},
+			"1.1.1.6": {"crawl-1-1-1-6.googlebot.com."},
+			"1.1.1.7": {"7.1.1.1.bc.googleusercontent.com."},
+		},
+		hosts: map[string][]string{
+			"crawl-1-1-1-1.googlebot.com":      {"1.1.1.1"},
+			"crawl.googlebot.com.example.net":  {"1.1.1.2"},
+			"crawl-1-1-1-3.googlebot.com":      {"1.1.1.99"},
+			"crawl-1-1-1-6.googlebot.com":      {"1.1.1.6"},
+			"7.1.1.1.bc.googleusercontent.com": {"1.1.1.7"},
+		},
+	}
+
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.IPV6.BIN"}
+	c.Resolver = resolver
+	c.Crawlers = []geoblock.Crawler{
+		{Name: "bingbot", Ranges: []string{ranges}},
+	}
+	c.Allowlist = []geoblock.Rule{
+		{Type: geoblock.RuleTypeCountry, Value: "fr"},
+		{Type: geoblock.RuleTypeCrawler, Value: "googlebot"},
+		{Type: geoblock.RuleTypeCrawler, Value: "Bingbot"},
+	}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	bingbot := "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+
+	tests := []struct {
+		name    string
+		ip      string
+		agent   string
+		status  int
+		lookups int // Total DNS lookups after the request.
+	}{
+		{name: "googlebot", ip: "1.1.1.1", agent: googlebot, status: http.StatusTeapot, lookups: 2},
+		{name: "googlebot cached", ip: "1.1.1.1", agent: googlebot, status: http.StatusTeapot, lookups: 2},
+		{name: "spoofed user agent", ip: "1.1.1.1", agent: "curl/8.0", status: http.StatusForbidden, lookups: 2},
+		{name: "foreign domain", ip: "1.1.1.2", agent: googlebot, status: http.StatusForbidden, lookups: 3},
+		{name: "unconfirmed", ip: "1.1.1.3", agent: googlebot, status: http.StatusForbidden, lookups: 5},
+		{name: "unconfirmed cached", ip: "1.1.1.3", agent: googlebot, status: http.StatusForbidden, lookups: 5},
+		{name: "no reverse", ip: "1.1.1.4", agent: googlebot, status: http.StatusForbidden, lookups: 6},
+		{name: "bingbot ipv4 range", ip: "1.1.1.200", agent: bingbot, status: http.StatusTeapot, lookups: 6},
+		{name: "bingbot ipv6 range", ip: "2606:4700::1", agent: bingbot, status: http.StatusTeapot, lookups: 6},
+		{name: "bingbot dns", ip: "2606:4700:1::1", agent: bingbot, status: http.StatusForbidden, lookups: 7},
+		{name: "too many names", ip: "1.1.1.5", agent: googlebot, status: http.StatusForbidden, lookups: 12},
+		{name: "cloud vm", ip: "1.1.1.7", agent: googlebot, status: http.StatusForbidden, lookups: 13},
+		{name: "too many ips", ip: "80.67.169.20, 80.67.169.21, 80.67.169.22, 1.1.1.20", agent: googlebot, status: http.StatusForbidden, lookups: 15},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", test.ip)
+		req.Header.Set("User-Agent", test.agent)
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+
+		assert.Equal(t, test.status, rr.Code, test.name)
+		assert.Equal(t, test.lookups, resolver.lookups, test.name)
+	}
+
+	// Concurrent requests share the verifications.
+	resolver.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", "1.1.1.6")
+			req.Header.Set("User-Agent", googlebot)
+
+			rr := httptest.NewRecorder()
+			plugin.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusTeapot, rr.Code)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 17, resolver.lookups)
+
+	//
+
+	for _, test := range []struct {
+		crawlers []geoblock.Crawler
+		rule     string
+		message  string
+	}{
+		{rule: "yandexbot", message: `geoblock: evaluator: geoblock: crawler rule "yandexbot": unknown crawler: yandexbot`},
+		{
+			crawlers: []geoblock.Crawler{{Name: "yandexbot", Domains: []string{"yandex.ru"}}},
+			rule:     "yandexbot",
+			message:  `geoblock: evaluator: geoblock: crawler "yandexbot": missing user agent`,
+		},
+		{
+			crawlers: []geoblock.Crawler{{Name: "yandexbot", UserAgent: "YandexBot"}},
+			rule:     "yandexbot",
+			message:  `geoblock: evaluator: geoblock: crawler "yandexbot": no domain nor range to verify it`,
+		},
+		{
+			crawlers: []geoblock.Crawler{{Name: "googlebot", Ranges: []string{filepath.Join(dir, "missing.json")}}},
+			rule:     "googlebot",
+			message:  fmt.Sprintf(`geoblock: evaluator: geoblock: crawler "googlebot": open %s: no such file or directory`, filepath.Join(dir, "missing.json")),
+		},
+	} {
+		c.Crawlers = test.crawlers
+		c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCrawler, Value: test.rule}}
+
+		_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.EqualError(t, err, test.message)
+	}
+}
+
+func TestPlugin_Challenge(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{"IP2LOCATION-LITE-DB1.BIN"}
+	c.Challenge = geoblock.Challenge{Secret: "hN4sK8wQ1zR6tY3uV9bX2cM5nB7vL0pA", TTL: "1h"}
+	c.Policies = []geoblock.Policy{
+		{
+			Name:      "admin",
+			Match:     geoblock.Match{Paths: []string{"/admin"}},
+			Blocklist: []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "us", Action: geoblock.Action{Type: geoblock.ActionChallenge, Difficulty: 12}}},
+		},
+	}
+	c.Allowlist = []geoblock.Rule{{Type: geoblock.RuleTypeCountry, Value: "fr"}}
+	c.Blocklist = []geoblock.Rule{
+		{Type: geoblock.RuleTypeCountry, Value: "us", Action: geoblock.Action{Type: geoblock.ActionChallenge, Difficulty: 8}},
+	}
+
+	plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.NoError(t, err)
+	defer plugin.(io.Closer).Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	serve := func(target, ip string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		req.Header.Set("Accept", "text/html,*/*;q=0.8")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+
+		rr := httptest.NewRecorder()
+		plugin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Issuing.
+	rr := serve("/page?x=1", "1.1.1.1")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store, private", rr.Header().Get("Cache-Control"))
+
+	page := regexp.MustCompile(`var challenge = "([0-9a-f.]+)", difficulty = *(\d+) *, action = "([^"]+)"`)
+
+	m := page.FindStringSubmatch(rr.Body.String())
+	if !assert.Len(t, m, 4, rr.Body.String()) {
+		return
+	}
+	challenge := m[1]
+	assert.Equal(t, "8", m[2])
+	assert.Equal(t, geoblock.ChallengePath, m[3])
+
+	// Solving, as the challenge page does.
+	solve := func(challenge string, difficulty int) (solution, wrong string) {
+		for n := 0; solution == "" || wrong == ""; n++ {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", challenge, n)))
+
+			zeros := 0
+			for _, b := range sum {
+				zeros += bits.LeadingZeros8(b)
+				if b != 0 {
+					break
+				}
+			}
+
+			if zeros >= difficulty && solution == "" {
+				solution = strconv.Itoa(n)
+			}
+			if zeros < difficulty && wrong == "" {
+				wrong = strconv.Itoa(n)
+			}
+		}
+
+		return solution, wrong
+	}
+	solution, wrong := solve(challenge, 8)
+
+	submit := func(challenge, nonce, redirect, ip string) *httptest.ResponseRecorder {
+		q := url.Values{"c": {challenge}, "n": {nonce}, "r": {redirect}}
+		return serve(geoblock.ChallengePath+"?"+q.Encode(), ip)
+	}
+
+	for _, test := range []struct {
+		name     string
+		nonce    string
+		redirect string
+		ip       string
+		location string
+	}{
+		{name: "wrong solution", nonce: wrong, redirect: "/page?x=1", ip: "1.1.1.1", location: "/page?x=1"},
+		{name: "other ip", nonce: solution, redirect: "/page?x=1", ip: "1.1.1.2", location: "/page?x=1"},
+		{name: "open redirect", nonce: wrong, redirect: "//evil.example/", ip: "1.1.1.1", location: "/"},
+		{name: "open redirect with backslash", nonce: wrong, redirect: "/\\evil.example/", ip: "1.1.1.1", location: "/"},
+		{name: "open redirect with tab", nonce: wrong, redirect: "/\t/evil.example/", ip: "1.1.1.1", location: "/"},
+		{name: "open redirect with newline", nonce: wrong, redirect: "/\n/evil.example/", ip: "1.1.1.1", location: "/"},
+		{name: "open redirect with scheme", nonce: wrong, redirect: "https://evil.example/", ip: "1.1.1.1", location: "/"},
+		{name: "open redirect with invalid escape", nonce: wrong, redirect: "/%zz", ip: "1.1.1.1", location: "/"},
+	} {
+		rr = submit(challenge, test.nonce, test.redirect, test.ip)
+		assert.Equal(t, http.StatusSeeOther, rr.Code, test.name)
+		assert.Equal(t, test.location, rr.Header().Get("Location"), test.name)
+		assert.Empty(t, rr.Result().Cookies(), test.name)
+	}
+
+	rr = submit(challenge, solution, "/page?x=1", "1.1.1.1")
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Equal(t, "/page?x=1", rr.Header().Get("Location"))
+	if !assert.Len(t, rr.Result().Cookies(), 1) {
+		return
+	}
+
+	pass := rr.Result().Cookies()[0]
+	assert.Equal(t, geoblock.DefaultChallengeCookie, pass.Name)
+	assert.Equal(t, 3600, pass.MaxAge)
+	assert.True(t, pass.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, pass.SameSite)
+
+	// Verifying.
+	assert.Equal(t, http.StatusTeapot, serve("/page?x=1", "1.1.1.1", pass).Code)
+	assert.Equal(t, http.StatusForbidden, serve("/page?x=1", "1.1.1.2", pass).Code)
+	assert.Equal(t, http.StatusForbidden, serve("/page?x=1", "1.1.1.1", &http.Cookie{Name: pass.Name, Value: strings.Replace(pass.Value, ".8.", ".12.", 1)}).Code)
+
+	// Stricter challenges require their own solution.
+	rr = serve("/admin", "1.1.1.1", pass)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	if m = page.FindStringSubmatch(rr.Body.String()); assert.Len(t, m, 4) {
+		assert.Equal(t, "12", m[2])
+	}
+
+	// Only browsers are challenged.
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	plugin.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	assert.Equal(t, geoblock.Stats{Requests: 6, Blocked: 5, Challenged: 4}, plugin.(*geoblock.Plugin).Stats())
+
+	assert.Contains(t, logs.String(), `geoblock: [example.com GET /page] blocked request from US (1.1.1.1) answered by ip2location matched by country rule "us", action challenge 403`)
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /.well-known/geoblock/challenge] rejected challenge solution from (1.1.1.1): invalid solution\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /.well-known/geoblock/challenge] rejected challenge solution from (1.1.1.2): invalid challenge signature\n")
+	assert.Contains(t, logs.String(), "geoblock: [example.com GET /.well-known/geoblock/challenge] solved challenge from (1.1.1.1), difficulty 8\n")
+
+	//
+
+	c.Challenge.Secret = ""
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: challenge action: missing challenge secret")
+
+	c.Challenge.Secret = "secret"
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, "geoblock: challenge: secret shorter than 32 bytes")
+
+	c.Challenge.Secret = "hN4sK8wQ1zR6tY3uV9bX2cM5nB7vL0pA"
+	c.Blocklist[0].Action.Difficulty = 33
+	_, err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+	assert.EqualError(t, err, `geoblock: evaluator: geoblock: country rule "us": challenge action: invalid difficulty: 33`)
+}
+
+func TestPlugin_CollectIPs(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1,,10.0.0.2")
+	req.Header.Set("X-Real-IP", "10.0.0.2")
+
+	var p geoblock.Plugin
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{"203.0.113.7", "10.0.0.1", "10.0.0.2"}, p.CollectIPs(req))
+	}
+}
+
+func TestPlugin_Close(t *testing.T) {
+	c := geoblock.CreateConfig()
+	c.Enabled = true
+	c.Databases = []string{
+		"IP2LOCATION-LITE-DB1.BIN",
+		"IP2LOCATION-LITE-DB1.IPV6.BIN",
+	}
+
+	gc()
+	fds := openfds(t)
+
+	for i := 0; i < 100; i++ {
+		plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.NoError(t, err)
+		assert.NoError(t, plugin.(io.Closer).Close())
+	}
+
+	// Shared databases are released with the last instance.
+	plugins := make([]http.Handler, 100)
+	for i := range plugins {
+		var err error
+		plugins[i], err = geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.NoError(t, err)
+	}
+	for _, plugin := range plugins {
+		assert.NoError(t, plugin.(io.Closer).Close())
+	}
+
+	gc()
+	assert.Equal(t, fds, openfds(t))
+
+	// Traefik drops the instances without closing them (e.g. on configuration reload).
+	for i := 0; i < 100; i++ {
+		plugin, err := geoblock.New(nil, new(noopHandler), c, "geoblock")
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		plugin.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	gc()
+	assert.Equal(t, fds, openfds(t))
+
+	//
+
+	for i := 0; i < 100; i++ {
+		f, err := os.Open(c.Databases[0])
+		assert.NoError(t, err)
+
+		rc := *c
+		rc.DatabaseReaders = []lookup.Reader{{ReadCloser: f, ReaderAt: f}}
+
+		plugin, err := geoblock.New(nil, new(noopHandler), &rc, "geoblock")
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		plugin.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.NoError(t, plugin.(io.Closer).Close())
+
+		_, err = f.Stat()
+		assert.ErrorIs(t, err, os.ErrClosed)
+	}
+}
+
+// archive writes the given files into a zip or gzip archive.
+func archive(t *testing.T, filename string, files ...string) {
+	w, err := os.Create(filename)
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+	defer w.Close()
+
+	if strings.HasSuffix(filename, ".gz") {
+		codec := gzip.NewWriter(w)
+		defer codec.Close()
+
+		payload, err := os.ReadFile(files[0])
+		assert.NoError(t, err)
+
+		_, err = codec.Write(payload)
+		assert.NoError(t, err)
+		return
+	}
+
+	codec := zip.NewWriter(w)
+	defer codec.Close()
+
+	for _, file := range files {
+		payload, err := os.ReadFile(file)
+		assert.NoError(t, err)
+
+		f, err := codec.Create(filepath.Base(file))
+		assert.NoError(t, err)
+
+		_, err = f.Write(payload)
+		assert.NoError(t, err)
+	}
+}
+
+// gc runs the finalizers of the dropped plugins and collects the dropped file handles.
+func gc() {
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openfds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open file descriptors not available:", err)
+	}
+
+	return len(entries)
+}
+
+// fixtures writes the test databases.
+func fixtures(dir string) error {
+	ranges := []struct {
+		from, to string
+		country  string
+	}{
+		{from: "1.1.1.0", to: "1.1.1.255", country: "US"},
+		{from: "80.67.169.0", to: "80.67.169.255", country: "FR"},
+		{from: "2001:910::", to: "2001:910:ffff:ffff:ffff:ffff:ffff:ffff", country: "FR"},
+		{from: "2606:4700::", to: "2606:4700:ffff:ffff:ffff:ffff:ffff:ffff", country: "US"},
+	}
+
+	for name, ipv6 := range map[string]bool{
+		"IP2LOCATION-LITE-DB1.BIN":      false,
+		"IP2LOCATION-LITE-DB1.IPV6.BIN": true,
+	} {
+		w, err := ip2locationbin.NewWriter(ip2locationbin.DB1, time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return err
+		}
+
+		for _, r := range ranges {
+			from, to := netip.MustParseAddr(r.from), netip.MustParseAddr(r.to)
+			if from.Is6() && !ipv6 {
+				continue
+			}
+
+			if err = w.Add(ip2locationbin.Range{From: from, To: to, Country: r.country}); err != nil {
+				return err
+			}
+		}
+
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.WriteTo(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
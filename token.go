@@ -0,0 +1,231 @@
+package geoblock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default token locations.
+const (
+	DefaultTokenHeader = "X-Geoblock-Token"
+	DefaultTokenCookie = "geoblock_token"
+	DefaultTokenQuery  = "geoblock_token"
+)
+
+// Minimum length of the token keys.
+const minTokenSecret = 32
+
+// Maximum length of the unknown key ids written to the logs.
+const maxLoggedKeyID = 32
+
+// Token verification errors.
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenKey       = errors.New("unknown key")
+	errTokenSignature = errors.New("invalid signature")
+	errTokenExpired   = errors.New("expired token")
+)
+
+// A claims is the verified content of a bypass token.
+type claims struct {
+	KeyID   string
+	Subject string // Bearer of the token (e.g. alice@example.com).
+	Expires time.Time
+}
+
+// describe describes the claims for the logs.
+func (c claims) describe() string {
+	if c.KeyID == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" with the token of %q (key %s, expires %s)", c.Subject, c.KeyID, c.Expires.Format(time.RFC3339))
+}
+
+// IssueToken returns a bypass token of the given subject signed with the given key.
+// Tokens have the form <key id>.<base64url subject>.<unix expiry>.<base64url HMAC-SHA256 of the first three parts>.
+func IssueToken(key TokenKey, subject string, expires time.Time) (string, error) {
+	if err := key.validate(); err != nil {
+		return "", err
+	}
+
+	if subject == "" {
+		return "", errors.New("empty subject")
+	}
+
+	payload := key.ID + "." + base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(key.Secret), payload)), nil
+}
+
+func (k TokenKey) validate() error {
+	if k.ID == "" || strings.Contains(k.ID, ".") {
+		return fmt.Errorf("invalid key id: %q", k.ID)
+	}
+
+	if len(k.Secret) < minTokenSecret {
+		return fmt.Errorf("key %s: secret shorter than %d bytes", k.ID, minTokenSecret)
+	}
+
+	return nil
+}
+
+func sign(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// A tokens verifies the bypass tokens of the requests.
+type tokens struct {
+	keys   map[string][]byte
+	header string
+	cookie string
+	query  string
+}
+
+// newTokens validates the given tokens config, it returns nil when no key is configured.
+func newTokens(c Tokens) (*tokens, error) {
+	if len(c.Keys) == 0 {
+		return nil, nil
+	}
+
+	t := &tokens{
+		keys:   make(map[string][]byte),
+		header: c.Header,
+		cookie: c.Cookie,
+		query:  c.Query,
+	}
+	if t.header == "" {
+		t.header = DefaultTokenHeader
+	}
+	if t.cookie == "" {
+		t.cookie = DefaultTokenCookie
+	}
+	if t.query == "" {
+		t.query = DefaultTokenQuery
+	}
+
+	for _, k := range c.Keys {
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := t.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id: %s", k.ID)
+		}
+		t.keys[k.ID] = []byte(k.Secret)
+	}
+
+	return t, nil
+}
+
+// find returns the token of the given request, if any.
+func (t *tokens) find(r *http.Request) string {
+	if v := r.Header.Get(t.header); v != "" {
+		return v
+	}
+
+	if c, err := r.Cookie(t.cookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	return r.URL.Query().Get(t.query)
+}
+
+// strip removes the tokens from the given request: the header, the cookie and the query parameter.
+func (t *tokens) strip(r *http.Request) {
+	r.Header.Del(t.header)
+
+	if values := r.Header.Values("Cookie"); len(values) > 0 {
+		var kept []string
+		for _, v := range values {
+			for _, cookie := range strings.Split(v, ";") {
+				name, _, _ := strings.Cut(cookie, "=")
+				if strings.TrimSpace(name) != t.cookie && strings.TrimSpace(cookie) != "" {
+					kept = append(kept, strings.TrimSpace(cookie))
+				}
+			}
+		}
+
+		r.Header.Del("Cookie")
+		if len(kept) > 0 {
+			r.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+
+	// The other parameters are kept as sent, in order and escaped the same (e.g. signed URLs).
+	if r.URL.RawQuery != "" {
+		var kept []string
+		for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+			name, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(name); err == nil && name == t.query {
+				continue
+			}
+
+			kept = append(kept, pair)
+		}
+
+		if query := strings.Join(kept, "&"); query != r.URL.RawQuery {
+			r.URL.RawQuery = query
+			r.RequestURI = r.URL.RequestURI()
+		}
+	}
+}
+
+// verify returns the claims of the given token when it is valid at the given time.
+func (t *tokens) verify(token string, now time.Time) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return claims{}, errTokenMalformed
+	}
+
+	secret, ok := t.keys[parts[0]]
+	if !ok {
+		// The key id is sent by the client, it is quoted and truncated for the logs.
+		id := parts[0]
+		if len(id) > maxLoggedKeyID {
+			id = id[:maxLoggedKeyID] + "..."
+		}
+
+		return claims{}, fmt.Errorf("%w: %q", errTokenKey, id)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return claims{}, errTokenMalformed
+	}
+
+	if !hmac.Equal(signature, sign(secret, strings.Join(parts[:3], "."))) {
+		return claims{}, errTokenSignature
+	}
+
+	// The payload is trusted from here.
+	subject, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims{}, errTokenMalformed
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return claims{}, errTokenMalformed
+	}
+
+	c := claims{
+		KeyID:   parts[0],
+		Subject: string(subject),
+		Expires: time.Unix(expires, 0).UTC(),
+	}
+	if !now.Before(c.Expires) {
+		return c, errTokenExpired
+	}
+
+	return c, nil
+}